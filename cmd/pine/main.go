@@ -3,20 +3,27 @@ package main
 import (
 	"fmt"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
 
 	pine "github.com/ydzhou/pine/internal"
 )
 
+// File argument with position as printed by compilers and grep, "path:line[:col]"
+var fileArgPattern = regexp.MustCompile(`^(.+?):(\d+)(?::(\d+))?:?$`)
+
 func main() {
-	sett, filename := parseInput(os.Args)
+	sett, files := parseInput(os.Args)
 	editor := pine.Editor{}
 	editor.Init(sett)
-	editor.Start(filename)
+	editor.Start(files)
 }
 
-func parseInput(args []string) (*pine.Setting, string) {
-	sett := &pine.Setting{}
-	filename := ""
+func parseInput(args []string) (*pine.Setting, []pine.FileArg) {
+	sett := pine.NewSetting()
+	files := []pine.FileArg{}
+	line := 0
 	for i, arg := range args {
 		if i == 0 {
 			continue
@@ -26,11 +33,46 @@ func parseInput(args []string) (*pine.Setting, string) {
 		} else if arg == "--version" || arg == "-v" {
 			printVersion()
 			os.Exit(0)
+		} else if strings.HasPrefix(arg, "--") {
+			// "--key=value" overrides the config file, a bare "--key" turns an option on
+			key, value, ok := strings.Cut(arg[2:], "=")
+			if !ok {
+				value = "on"
+			}
+			if err := sett.SetFlag(key, value); err != nil {
+				fmt.Fprintf(os.Stderr, "pe: %v\n", err)
+				os.Exit(2)
+			}
+		} else if n, err := strconv.Atoi(strings.TrimPrefix(arg, "+")); strings.HasPrefix(arg, "+") && err == nil {
+			// vi style "+N path", the line applies to the next file
+			line = n
 		} else {
-			filename = arg
+			file := parseFileArg(arg)
+			if line > 0 {
+				file.Line, file.Col = line, 0
+				line = 0
+			}
+			files = append(files, file)
 		}
 	}
-	return sett, filename
+	return sett, files
+}
+
+// An existing file is taken as is even if its name looks like "path:line"
+func parseFileArg(arg string) pine.FileArg {
+	if _, err := os.Stat(arg); err == nil {
+		return pine.FileArg{Path: arg}
+	}
+	m := fileArgPattern.FindStringSubmatch(arg)
+	if m == nil {
+		return pine.FileArg{Path: arg}
+	}
+	file := pine.FileArg{Path: m[1]}
+	file.Line, _ = strconv.Atoi(m[2])
+	if m[3] != "" {
+		file.Col, _ = strconv.Atoi(m[3])
+	}
+	return file
 }
 
 func printVersion() {
@@ -7,7 +7,10 @@ require (
 	github.com/sirupsen/logrus v1.9.0
 )
 
-require github.com/mattn/go-runewidth v0.0.13
+require (
+	github.com/mattn/go-runewidth v0.0.13
+	golang.org/x/text v0.14.0
+)
 
 require (
 	github.com/rivo/uniseg v0.2.0 // indirect
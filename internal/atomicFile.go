@@ -0,0 +1,90 @@
+package pine
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Write a file through a temp file in the same directory which is synced and
+// renamed over the target, so that the target is either the old or the new
+// content even if the write fails halfway
+// A symlink target is resolved and the real file is replaced, mode and owner of
+// an existing file are kept, backup keeps the old content as "file~"
+func writeFileAtomic(path string, backup bool, write func(io.Writer) (int, error)) (int, error) {
+	realPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return 0, err
+		}
+		realPath = path
+	}
+	mode := os.FileMode(0644)
+	stat, err := os.Stat(realPath)
+	exists := err == nil
+	if exists {
+		if !stat.Mode().IsRegular() {
+			return 0, fmt.Errorf("%s is not a regular file", realPath)
+		}
+		mode = stat.Mode().Perm()
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	dir, name := filepath.Split(realPath)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := os.CreateTemp(dir, "."+name+".pe-tmp-*")
+	if err != nil {
+		return 0, err
+	}
+	// Temp file is removed unless it has been renamed over the target
+	defer os.Remove(tmp.Name())
+
+	n, err := write(tmp)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return 0, err
+	}
+	if exists {
+		copyFileOwner(stat, tmp.Name())
+		if backup {
+			if err := copyFile(realPath, realPath+"~", mode); err != nil {
+				return 0, fmt.Errorf("failed to backup %s: %v", realPath, err)
+			}
+		}
+	}
+	if err := os.Rename(tmp.Name(), realPath); err != nil {
+		return 0, err
+	}
+	syncDir(dir)
+	return n, nil
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dst, data, mode)
+}
+
+// Sync the directory so that the rename survives a crash, not every platform supports it
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+	d.Sync()
+}
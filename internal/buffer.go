@@ -2,7 +2,9 @@ package pine
 
 import (
 	"bufio"
+	"crypto/sha256"
 	"fmt"
+	"io"
 	"os"
 
 	log "github.com/sirupsen/logrus"
@@ -13,18 +15,47 @@ type Buffer struct {
 	dirty          bool
 	lastModifiedCh string
 	cursor         *Pos
-	hlStartPos     *Pos
-	hlEndPos       *Pos
+	mark           *Pos
+	highlights     []highlight
+	history        History
 	filePath       string
 	isDir          bool
-	readOnly       bool
-	log            *log.Logger
+	isGrep         bool
+	noFile         bool
+	crlf           bool
+	bom            bool
+	noEOL          bool
+	encoding       string
+	// Content had invalid bytes kept as escape runes
+	escaped     bool
+	expandTabs  bool
+	autoIndent  bool
+	isHex       bool
+	hexASCII    bool
+	data        []byte
+	onProgress  func(read, total int64)
+	edits       int
+	swapEdits   int
+	swapped     bool
+	pendingSwap bool
+	disk        diskState
+	diskChanged bool
+	askReload   bool
+	readOnly    bool
+	log         *log.Logger
 }
 
 type line struct {
 	txt []rune
 }
 
+// highlight is a range of buffer content painted with a style, endPos is exclusive
+type highlight struct {
+	startPos Pos
+	endPos   Pos
+	style    HighlightStyle
+}
+
 func (b *Buffer) New(path string, log *log.Logger) FileOpenState {
 	b.init(log)
 	b.filePath = path
@@ -35,18 +66,39 @@ func (b *Buffer) New(path string, log *log.Logger) FileOpenState {
 	return Success
 }
 
+// Create a buffer with content read from r, the buffer is not backed by a file
+// and asks for a filename on save
+func (b *Buffer) NewFromReader(name string, r io.Reader, log *log.Logger) FileOpenState {
+	b.init(log)
+	b.filePath = name
+	b.noFile = true
+	if err := b.loadContent(r, 0); err != nil {
+		b.log.Errorf("fail to read %s: %v", name, err)
+		b.readOnly = true
+		return ReadError
+	}
+	return Success
+}
+
 func (b *Buffer) ResetHightlight() {
-	b.hlStartPos = &Pos{-1, -1}
-	b.hlEndPos = &Pos{-1, -1}
+	b.highlights = []highlight{}
+}
+
+// Add a highlight range, later ranges are painted over earlier ones
+func (b *Buffer) AddHighlight(start, end Pos, style HighlightStyle) {
+	b.highlights = append(b.highlights, highlight{startPos: start, endPos: end, style: style})
 }
 
 func (b *Buffer) init(log *log.Logger) {
 	b.log = log
 	b.cursor = &Pos{x: 0, y: 0}
+	b.mark = &Pos{-1, -1}
 	b.ResetHightlight()
 	b.lines = []line{}
+	b.escaped = false
 	b.lastModifiedCh = "NA"
 	b.dirty = false
+	b.history.Reset()
 }
 
 func (b *Buffer) newEmptyBuffer() {
@@ -75,14 +127,50 @@ func (b *Buffer) openFile(path string) FileOpenState {
 	}
 
 	defer f.Close()
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		b.lines = append(b.lines, line{txt: []rune(scanner.Text())})
-	}
 	b.filePath = path
+	size := int64(0)
+	if stat, err := f.Stat(); err == nil {
+		size = stat.Size()
+	}
+	h := sha256.New()
+	if err := b.loadContent(io.TeeReader(f, h), size); err != nil {
+		// Partial content must not be saved over the file
+		b.log.Errorf("fail to read %s: %v", path, err)
+		b.readOnly = true
+		return ReadError
+	}
+	b.recordDiskState(h.Sum(nil))
 	return Success
 }
 
+// Read lines of any length, size is the expected total bytes used to report
+// loading progress of large files, 0 if unknown
+func (b *Buffer) readLines(r io.Reader, size int64) error {
+	reader := bufio.NewReaderSize(r, READ_BUFFER_SIZE)
+	read := int64(0)
+	nextReport := int64(LARGE_FILE_SIZE)
+	for {
+		raw, err := reader.ReadString('\n')
+		if len(raw) > 0 {
+			txt := b.parseRawLine(raw, len(b.lines) == 0)
+			runes, escaped := decodeUTF8(txt)
+			b.lines = append(b.lines, line{txt: runes})
+			b.escaped = b.escaped || escaped
+			read += int64(len(raw))
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if b.onProgress != nil && size >= LARGE_FILE_SIZE && read >= nextReport {
+			b.onProgress(read, size)
+			nextReport = read + size/LOAD_PROGRESS_STEPS
+		}
+	}
+}
+
 func isDirectory(f *os.File) bool {
 	stat, err := f.Stat()
 	if err != nil {
@@ -116,6 +204,11 @@ func (b *Buffer) openDir(path string) error {
 	return nil
 }
 
+// Check if the buffer is backed by a file
+func (b *Buffer) hasFile() bool {
+	return !b.noFile && !b.isDir && b.filePath != ""
+}
+
 func (b *Buffer) getCurrDirPath() string {
 	if !b.isDir {
 		log.Errorf("Cannot get directory in non directory buffer %s", b.filePath)
@@ -130,9 +223,12 @@ func (b *Buffer) NewLine() {
 
 	x := b.cursor.x
 	y := b.cursor.y
+	before := *b.cursor
 
 	if b.isEmpty() {
-		b.lines = append(b.lines, line{})
+		ed := edit{kind: insertLineEdit, pos: Pos{0, 0}}
+		b.applyEdit(ed)
+		b.commit([]edit{ed}, before, false)
 		return
 	}
 
@@ -140,68 +236,82 @@ func (b *Buffer) NewLine() {
 		panic(fmt.Errorf("failed to create new line at (%d,%d)", x, y))
 	}
 
-	indention := getIndention(b.lines[x].txt)
-
-	line := line{txt: []rune{}}
-	if y <= len(b.lines[x].txt) {
-		line.txt = make([]rune, len(b.lines[x].txt[:y]))
-		copy(line.txt, b.lines[x].txt[:y])
-		nextLineTxt := make([]rune, len(b.lines[x].txt[y:]))
-		copy(nextLineTxt, b.lines[x].txt[y:])
-		b.lines[x].txt = nextLineTxt
+	var indention, existIndention []rune
+	if b.autoIndent {
+		indention = getIndention(b.lines[x].txt)
+		existIndention = getIndention(b.lines[x].txt[y:])
 	}
 
-	b.lines = append(b.lines, line)
-	copy(b.lines[x+1:], b.lines[x:])
-	b.lines[x] = line
-
+	txt := []rune{'\n'}
+	if len(indention) > len(existIndention) {
+		txt = append(txt, indention[:len(indention)-len(existIndention)]...)
+	}
+	ed := edit{kind: insertTextEdit, pos: Pos{x, y}, txt: txt}
+	b.applyEdit(ed)
 	b.cursor.x++
-	b.cursor.y = 0
-
-	b.applyIndention(b.cursor.x, indention)
+	b.cursor.y = len(indention)
+	b.commit([]edit{ed}, before, false)
 }
 
 func (b *Buffer) Insert(data rune) {
 	defer b.setDirty()
 	x := b.cursor.x
 	y := b.cursor.y
-	b.cursor.y++
+	before := *b.cursor
 	b.lastModifiedCh = fmt.Sprintf("+%s", string(data))
 
+	edits := []edit{}
 	// Append a new line if cursor is under the last line
 	if x == len(b.lines) {
-		b.lines = append(b.lines, line{})
+		ed := edit{kind: insertLineEdit, pos: Pos{x, 0}}
+		b.applyEdit(ed)
+		edits = append(edits, ed)
 	}
 
 	if x > len(b.lines)-1 || y > len(b.lines[x].txt) {
 		panic(fmt.Errorf("failed to insert [%s] at (%d,%d)", string(data), x, y))
 	}
 
-	b.lines[x].txt = append(b.lines[x].txt, data)
-	if y == len(b.lines[x].txt)-1 {
-		return
-	}
-
-	copy(b.lines[x].txt[y+1:], b.lines[x].txt[y:])
-	b.lines[x].txt[y] = data
+	ed := edit{kind: insertTextEdit, pos: Pos{x, y}, txt: []rune{data}}
+	b.applyEdit(ed)
+	edits = append(edits, ed)
+	b.cursor.y++
+	b.commit(edits, before, true)
 }
 
+// Insert a tab, or spaces up to the next tab stop if tabs are expanded
 func (b *Buffer) InsertTab() {
-	b.Insert(rune('\t'))
-	b.setDirty()
+	if !b.expandTabs {
+		b.Insert(rune('\t'))
+		return
+	}
+	col := 0
+	if b.cursor.x < len(b.lines) {
+		for _, r := range b.lines[b.cursor.x].txt[:b.cursor.y] {
+			col += runeRenderedWidth(col, r)
+		}
+	}
+	for i := tabWidth - col%tabWidth; i > 0; i-- {
+		b.Insert(' ')
+	}
 }
 
-func (b *Buffer) DeleteLine() {
+// Delete current line and return its content
+func (b *Buffer) DeleteLine() []rune {
 	if b.isEmpty() {
-		return
+		return nil
 	}
-	b.removeLine()
+	before := *b.cursor
+	ed := edit{kind: deleteLineEdit, pos: Pos{b.cursor.x, 0}, txt: b.lines[b.cursor.x].txt}
+	b.applyEdit(ed)
 	if b.cursor.x > 0 {
 		b.cursor.x--
 	}
 	b.cursor.y = 0
 	b.lastModifiedCh = "-line"
+	b.commit([]edit{ed}, before, false)
 	b.setDirty()
+	return ed.txt
 }
 
 func (b *Buffer) Delete() {
@@ -212,73 +322,340 @@ func (b *Buffer) Delete() {
 		return
 	}
 	defer b.setDirty()
+	before := *b.cursor
 	// Remove newline
 	if y == 0 {
-		b.cursor.y = len(b.lines[x-1].txt)
-		b.lines[x-1].txt = append(b.lines[x-1].txt, b.lines[x].txt...)
-		b.removeLine()
-		b.cursor.x = b.cursor.x - 1
+		ed := edit{kind: deleteTextEdit, pos: Pos{x - 1, len(b.lines[x-1].txt)}, txt: []rune{'\n'}}
+		b.applyEdit(ed)
+		*b.cursor = ed.pos
 		b.lastModifiedCh = "-newline"
+		b.commit([]edit{ed}, before, false)
 		return
 	}
 	b.lastModifiedCh = fmt.Sprintf("-%s", string(b.lines[x].txt[y-1]))
+	ed := edit{kind: deleteTextEdit, pos: Pos{x, y - 1}, txt: []rune{b.lines[x].txt[y-1]}}
+	b.applyEdit(ed)
 	b.cursor.y--
-	b.removeRune()
+	b.commit([]edit{ed}, before, false)
 }
 
-func (b *Buffer) removeLine() {
+// Delete the character at cursor, at end of line join the next line
+func (b *Buffer) DeleteForward() {
 	x := b.cursor.x
-	if x == 0 {
-		b.lines[0] = line{}
+	y := b.cursor.y
+	if b.isEmpty() || (x == len(b.lines)-1 && y == len(b.lines[x].txt)) {
+		b.lastModifiedCh = string("NA")
+		return
+	}
+	defer b.setDirty()
+	before := *b.cursor
+	ed := edit{kind: deleteTextEdit, pos: Pos{x, y}, txt: []rune{'\n'}}
+	b.lastModifiedCh = "-newline"
+	if y < len(b.lines[x].txt) {
+		ed.txt = []rune{b.lines[x].txt[y]}
+		b.lastModifiedCh = fmt.Sprintf("-%s", string(ed.txt))
 	}
-	if x < len(b.lines)-1 {
-		copy(b.lines[x:], b.lines[x+1:])
+	b.applyEdit(ed)
+	b.commit([]edit{ed}, before, false)
+}
+
+// Insert text at cursor as a single undo step and move cursor to its end
+func (b *Buffer) InsertText(txt []rune) {
+	if len(txt) == 0 {
+		return
 	}
-	if len(b.lines) > 0 {
-		b.lines = b.lines[:len(b.lines)-1]
+	defer b.setDirty()
+	before := *b.cursor
+	edits := []edit{}
+	if b.cursor.x == len(b.lines) {
+		ed := edit{kind: insertLineEdit, pos: Pos{b.cursor.x, 0}}
+		b.applyEdit(ed)
+		edits = append(edits, ed)
 	}
+	ed := edit{kind: insertTextEdit, pos: *b.cursor, txt: append([]rune{}, txt...)}
+	b.applyEdit(ed)
+	edits = append(edits, ed)
+	*b.cursor = getTextEndPos(ed.pos, ed.txt)
+	b.lastModifiedCh = "+text"
+	b.commit(edits, before, false)
 }
 
-func (b *Buffer) removeRune() {
-	x := b.cursor.x
-	y := b.cursor.y
-	if y < len(b.lines[x].txt)-1 {
-		copy(b.lines[x].txt[y:], b.lines[x].txt[y+1:])
+// Delete text between start and end, move cursor to start and return deleted text
+func (b *Buffer) DeleteText(start, end Pos) []rune {
+	txt := b.getText(start, end)
+	if len(txt) == 0 {
+		return txt
 	}
-	b.lines[x].txt = b.lines[x].txt[:len(b.lines[x].txt)-1]
+	defer b.setDirty()
+	before := *b.cursor
+	ed := edit{kind: deleteTextEdit, pos: start, txt: txt}
+	b.applyEdit(ed)
+	*b.cursor = start
+	b.lastModifiedCh = "-text"
+	b.commit([]edit{ed}, before, false)
+	return txt
 }
 
-func (b *Buffer) Save(path string) (int, error) {
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
-	if err != nil {
-		return 0, err
+// Set mark at cursor, the region spans from mark to cursor
+func (b *Buffer) SetMark() {
+	b.mark = &Pos{b.cursor.x, b.cursor.y}
+}
+
+func (b *Buffer) ClearMark() {
+	if !b.hasMark() {
+		return
 	}
-	defer f.Close()
+	b.mark = &Pos{-1, -1}
+	b.ResetHightlight()
+}
+
+// Delete the region and return its content
+func (b *Buffer) KillRegion() []rune {
+	if !b.hasMark() {
+		return nil
+	}
+	start, end := b.getRegion()
+	txt := b.DeleteText(start, end)
+	b.ClearMark()
+	return txt
+}
 
-	writer := bufio.NewWriter(f)
+// Return the content of the region
+func (b *Buffer) CopyRegion() []rune {
+	if !b.hasMark() {
+		return nil
+	}
+	start, end := b.getRegion()
+	b.ClearMark()
+	return b.getText(start, end)
+}
+
+func (b *Buffer) hasMark() bool {
+	return b.mark.x >= 0
+}
 
-	totalbyte := 0
-	for _, l := range b.lines {
-		for _, d := range l.txt {
-			wbyte, err := writer.WriteString(string(d))
-			if err != nil {
-				return 0, err
-			}
-			totalbyte += wbyte
+// Return region boundaries ordered by position
+func (b *Buffer) getRegion() (Pos, Pos) {
+	mark := b.clampPos(*b.mark)
+	cursor := b.clampPos(*b.cursor)
+	if isPosBefore(cursor, mark) {
+		return cursor, mark
+	}
+	return mark, cursor
+}
+
+// Highlight the region between mark and cursor if mark is set
+func (b *Buffer) syncRegionHighlight() {
+	if !b.hasMark() {
+		return
+	}
+	start, end := b.getRegion()
+	b.ResetHightlight()
+	b.AddHighlight(start, end, RegionHighlight)
+}
+
+// Limit a position to buffer content
+func (b *Buffer) clampPos(p Pos) Pos {
+	if b.isEmpty() {
+		return Pos{0, 0}
+	}
+	if p.x >= len(b.lines) {
+		p.x = len(b.lines) - 1
+	}
+	if p.x < 0 {
+		p.x = 0
+	}
+	if p.y > len(b.lines[p.x].txt) {
+		p.y = len(b.lines[p.x].txt)
+	}
+	if p.y < 0 {
+		p.y = 0
+	}
+	return p
+}
+
+// Undo the last edit step and restore the cursor to where the step started
+// Returns false if there is nothing to undo
+func (b *Buffer) Undo() bool {
+	group := b.history.popUndo()
+	if group == nil {
+		return false
+	}
+	for i := len(group.edits) - 1; i >= 0; i-- {
+		b.applyEdit(group.edits[i].inverse())
+	}
+	*b.cursor = group.cursorBefore
+	b.ClearMark()
+	b.dirty = !b.history.isSaved()
+	b.lastModifiedCh = "undo"
+	return true
+}
+
+// Redo the last undone edit step
+// Returns false if there is nothing to redo
+func (b *Buffer) Redo() bool {
+	group := b.history.popRedo()
+	if group == nil {
+		return false
+	}
+	for _, ed := range group.edits {
+		b.applyEdit(ed)
+	}
+	*b.cursor = group.cursorAfter
+	b.ClearMark()
+	b.dirty = !b.history.isSaved()
+	b.lastModifiedCh = "redo"
+	return true
+}
+
+// Group all edits made until endEdit into a single undo step
+func (b *Buffer) beginEdit() {
+	b.history.begin(*b.cursor)
+}
+
+func (b *Buffer) endEdit() {
+	b.history.end(*b.cursor)
+}
+
+// Record edits of a buffer operation, any edit deactivates the mark
+func (b *Buffer) commit(edits []edit, before Pos, mergeable bool) {
+	b.history.record(edits, before, *b.cursor, mergeable)
+	b.ClearMark()
+}
+
+// Apply an edit on buffer lines without recording it
+func (b *Buffer) applyEdit(ed edit) {
+	b.edits++
+	switch ed.kind {
+	case insertTextEdit:
+		b.insertText(ed.pos, ed.txt)
+	case deleteTextEdit:
+		b.deleteText(ed.pos, getTextEndPos(ed.pos, ed.txt))
+	case insertLineEdit:
+		txt := make([]rune, len(ed.txt))
+		copy(txt, ed.txt)
+		b.lines = append(b.lines, line{})
+		copy(b.lines[ed.pos.x+1:], b.lines[ed.pos.x:])
+		b.lines[ed.pos.x] = line{txt: txt}
+	case deleteLineEdit:
+		b.lines = append(b.lines[:ed.pos.x], b.lines[ed.pos.x+1:]...)
+	case replaceByteEdit:
+		b.data[ed.pos.x] = byte(ed.txt[1])
+	}
+}
+
+// Insert text at given position, splitting lines on '\n'
+func (b *Buffer) insertText(p Pos, txt []rune) {
+	curr := b.lines[p.x].txt
+	tail := make([]rune, len(curr[p.y:]))
+	copy(tail, curr[p.y:])
+
+	segs := splitRunes(txt)
+	head := make([]rune, p.y, p.y+len(segs[0]))
+	copy(head, curr[:p.y])
+	b.lines[p.x].txt = append(head, segs[0]...)
+	if len(segs) == 1 {
+		b.lines[p.x].txt = append(b.lines[p.x].txt, tail...)
+		return
+	}
+
+	newLines := make([]line, 0, len(segs)-1)
+	for _, seg := range segs[1:] {
+		newLines = append(newLines, line{txt: append([]rune{}, seg...)})
+	}
+	last := &newLines[len(newLines)-1]
+	last.txt = append(last.txt, tail...)
+
+	rest := append(newLines, b.lines[p.x+1:]...)
+	b.lines = append(b.lines[:p.x+1], rest...)
+}
+
+// Delete text between start and end position, end is exclusive
+func (b *Buffer) deleteText(start, end Pos) {
+	head := b.lines[start.x].txt[:start.y]
+	tail := b.lines[end.x].txt[end.y:]
+	txt := make([]rune, 0, len(head)+len(tail))
+	txt = append(txt, head...)
+	txt = append(txt, tail...)
+	b.lines[start.x].txt = txt
+	if end.x > start.x {
+		b.lines = append(b.lines[:start.x+1], b.lines[end.x+1:]...)
+	}
+}
+
+// Return a copy of text between start and end position, end is exclusive
+func (b *Buffer) getText(start, end Pos) []rune {
+	txt := []rune{}
+	for x := start.x; x <= end.x && x < len(b.lines); x++ {
+		l := b.lines[x].txt
+		from, to := 0, len(l)
+		if x == start.x {
+			from = start.y
 		}
-		wbyte, err := writer.WriteString("\n")
-		if err != nil {
-			return 0, err
+		if x == end.x {
+			to = end.y
+		}
+		txt = append(txt, l[from:to]...)
+		if x != end.x {
+			txt = append(txt, '\n')
+		}
+	}
+	return txt
+}
+
+// Return the position right after txt if it is inserted at p
+func getTextEndPos(p Pos, txt []rune) Pos {
+	for _, r := range txt {
+		if r == '\n' {
+			p.x++
+			p.y = 0
+		} else {
+			p.y++
 		}
-		totalbyte += wbyte
 	}
-	writer.Flush()
+	return p
+}
 
+func splitRunes(txt []rune) [][]rune {
+	segs := [][]rune{}
+	start := 0
+	for i, r := range txt {
+		if r == '\n' {
+			segs = append(segs, txt[start:i])
+			start = i + 1
+		}
+	}
+	return append(segs, txt[start:])
+}
+
+// Save buffer content to path atomically, backup keeps the old file as "path~"
+func (b *Buffer) Save(path string, backup bool) (int, error) {
+	h := sha256.New()
+	totalbyte, err := writeFileAtomic(path, backup, func(w io.Writer) (int, error) {
+		return b.writeLines(io.MultiWriter(w, h))
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	b.removeSwap()
 	b.filePath = path
+	b.noFile = false
 	b.dirty = false
+	b.history.markSaved()
+	b.recordDiskState(h.Sum(nil))
+	b.diskChanged = false
+	b.askReload = false
 	return totalbyte, nil
 }
 
+// Append lines at the end without recording them in history, used by read-only buffers
+func (b *Buffer) appendLines(txts []string) {
+	for _, txt := range txts {
+		b.lines = append(b.lines, line{txt: []rune(txt)})
+	}
+}
+
 func (b *Buffer) InsertString(s string) {
 	for _, d := range s {
 		b.Insert(d)
@@ -293,15 +670,6 @@ func (b *Buffer) setDirty() {
 	b.dirty = true
 }
 
-func (b *Buffer) applyIndention(idx int, indention []rune) {
-	curr := b.lines[idx].txt
-	existIndention := getIndention(curr)
-	if len(indention) > len(existIndention) {
-		b.lines[idx].txt = append(indention[:(len(indention)-len(existIndention))], b.lines[idx].txt...)
-	}
-	b.cursor.y += len(indention)
-}
-
 func getIndention(runes []rune) []rune {
 	count := 0
 	for _, r := range runes {
@@ -0,0 +1,318 @@
+package pine
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	tm "github.com/nsf/termbox-go"
+)
+
+/*
+ * Command
+ *
+ * Every operation is registered as a named command, which is what keymap
+ * files bind keys to and what the command palette (M-x) runs. A command
+ * either runs a KeyOps as if its key was pressed, or calls run with an
+ * argument asked in a prompt.
+ */
+
+type Command struct {
+	name string
+	desc string
+	op   KeyOps
+	// Prompt for the argument passed to run, no prompt if empty
+	prompt string
+	run    func(e *Editor, arg string) error
+}
+
+var commands []Command
+
+// Commands are set up in init as some of them run commands themselves
+func init() {
+	commands = []Command{
+		{name: "exit", desc: "Exit the editor", op: ExitOp},
+		{name: "open-file", desc: "Open a file or directory", op: OpenFileOp},
+		{name: "save-file", desc: "Save buffer to its file", op: SaveFileOp},
+		{name: "close-file", desc: "Close current buffer", op: CloseFileOp},
+		{name: "help", desc: "Show help", op: HelpOp},
+		{name: "next-buffer", desc: "Switch to next buffer", op: NextBufferOp},
+		{name: "prev-buffer", desc: "Switch to previous buffer", op: PrevBufferOp},
+		{name: "move-up", desc: "Move cursor up a line", op: MoveCursorUpOp},
+		{name: "move-down", desc: "Move cursor down a line", op: MoveCursorDownOp},
+		{name: "move-left", desc: "Move cursor left a character", op: MoveCursorLeftOp},
+		{name: "move-right", desc: "Move cursor right a character", op: MoveCursorRightOp},
+		{name: "forward-word", desc: "Move cursor to end of next word", op: ForwardWordOp},
+		{name: "backward-word", desc: "Move cursor to start of previous word", op: BackwardWordOp},
+		{name: "next-half-page", desc: "Scroll down half a page", op: NextHalfPageOp},
+		{name: "prev-half-page", desc: "Scroll up half a page", op: PrevHalfPageOp},
+		{name: "beginning-of-line", desc: "Move cursor to beginning of line", op: GoToBOLOp},
+		{name: "end-of-line", desc: "Move cursor to end of line", op: GoToEOLOp},
+		{name: "beginning-of-buffer", desc: "Move cursor to beginning of buffer", op: GoToBODOp},
+		{name: "end-of-buffer", desc: "Move cursor to end of buffer", op: GoToEODOp},
+		{name: "goto-line", desc: "Go to a line and column", op: GoToLineOp},
+		{name: "toggle-wrap", desc: "Toggle soft wrap of long lines", op: ToggleWrapOp},
+		{name: "insert-space", desc: "Insert a space", op: InsertSpaceOp},
+		{name: "insert-tab", desc: "Insert a tab", op: InsertTabOp},
+		{name: "newline", desc: "Break line at cursor", op: InsertEnterOp},
+		{name: "delete-backward-char", desc: "Delete character before cursor", op: DeleteChOp},
+		{name: "delete-char", desc: "Delete character at cursor", op: DeleteForwardChOp},
+		{name: "kill-word", desc: "Kill to end of next word", op: KillWordOp},
+		{name: "backward-kill-word", desc: "Kill to start of previous word", op: BackwardKillWordOp},
+		{name: "kill-line", desc: "Kill current line", op: DeleteLineOp},
+		{name: "toggle-line-ending", desc: "Convert line endings between LF and CRLF", op: ToggleLineEndingOp},
+		{name: "reopen-in-encoding", desc: "Reopen file in an encoding", op: ReopenEncodingOp},
+		{name: "save-in-encoding", desc: "Convert buffer to an encoding on save", op: SaveEncodingOp},
+		{name: "undo", desc: "Undo last change", op: UndoOp},
+		{name: "redo", desc: "Redo last undone change", op: RedoOp},
+		{name: "set-mark", desc: "Set mark at cursor", op: SetMarkOp},
+		{name: "kill-region", desc: "Kill text between mark and cursor", op: KillRegionOp},
+		{name: "copy-region", desc: "Copy text between mark and cursor", op: CopyRegionOp},
+		{name: "yank", desc: "Insert last killed text", op: YankOp},
+		{name: "yank-pop", desc: "Replace yanked text with earlier kill", op: YankPopOp},
+		{name: "search", desc: "Search in buffer", op: SearchOp},
+		{name: "search-next", desc: "Go to next match", op: SearchNextOp},
+		{name: "search-prev", desc: "Go to previous match", op: SearchPrevOp},
+		{name: "replace", desc: "Query replace matches", op: ReplaceOp},
+		{name: "replace-all", desc: "Replace all matches", op: ReplaceAllOp},
+		{name: "toggle-case", desc: "Toggle ignore case in search", op: ToggleCaseOp},
+		{name: "toggle-literal", desc: "Toggle literal text in search", op: ToggleLiteralOp},
+		{name: "toggle-word", desc: "Toggle whole word in search", op: ToggleWordOp},
+		{name: "grep", desc: "Grep files under a directory", op: GrepOp},
+		{name: "history-prev", desc: "Previous prompt input", op: HistoryPrevOp},
+		{name: "history-next", desc: "Next prompt input", op: HistoryNextOp},
+		{name: "start-macro", desc: "Start recording keyboard macro", op: StartMacroOp},
+		{name: "stop-macro", desc: "Stop recording keyboard macro", op: StopMacroOp},
+		{name: "run-macro", desc: "Run last keyboard macro, or stop recording", op: RunMacroOp},
+		{name: "universal-argument", desc: "Repeat next command, 4 times or digits typed next", op: UniversalArgOp},
+		{name: "digit-argument", desc: "Repeat next command the number of times typed", op: DigitArgOp},
+		{name: "command", desc: "Run a command by name", op: CommandOp},
+		{name: "cancel", desc: "Cancel prompt or clear mark", op: CancelOp},
+		{name: "set-tab-width", desc: "Set tab width", prompt: "Tab width", run: setTabWidth},
+		{name: "run-macro-times", desc: "Run last keyboard macro N times", prompt: "Times, 0 runs until end of buffer", run: runMacroTimes},
+		{name: "save-macro", desc: "Save last keyboard macro under a name", prompt: "Save macro as", run: saveMacro},
+		{name: "play-macro", desc: "Load a saved keyboard macro and run it", prompt: "Play macro", run: playMacro},
+	}
+}
+
+func getCommand(name string) *Command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+// Return the command name of an operation
+func getOpName(op KeyOps) string {
+	for _, cmd := range commands {
+		if cmd.run == nil && cmd.op == op {
+			return cmd.name
+		}
+	}
+	return ""
+}
+
+func setTabWidth(e *Editor, arg string) error {
+	n, err := strconv.Atoi(strings.TrimSpace(arg))
+	if err != nil || n < 1 || n > MAX_TABWIDTH {
+		return fmt.Errorf("tab width must be a number from 1 to %d", MAX_TABWIDTH)
+	}
+	e.sett.TabWidth = n
+	tabWidth = n
+	e.setMsg(fmt.Sprintf("Tab width set to %d", n))
+	return nil
+}
+
+// Score how well name matches pattern, whose runes must appear in name in
+// order, runes at word start or right after the previous match score higher
+func getFuzzyScore(pattern, name string) (int, bool) {
+	p := []rune(strings.ToLower(pattern))
+	runes := []rune(name)
+	score, i, prev := 0, 0, -2
+	for j, r := range runes {
+		if i == len(p) {
+			break
+		}
+		if unicode.ToLower(r) != p[i] {
+			continue
+		}
+		score++
+		if j == prev+1 {
+			score += 4
+		}
+		if j == 0 || runes[j-1] == '-' {
+			score += 2
+		}
+		prev = j
+		i++
+	}
+	return score*100 - len(runes), i == len(p)
+}
+
+// Return commands matching input, best first
+func matchCommands(input string) []*Command {
+	type match struct {
+		cmd   *Command
+		score int
+	}
+	matches := []match{}
+	for i := range commands {
+		if score, ok := getFuzzyScore(strings.TrimSpace(input), commands[i].name); ok {
+			matches = append(matches, match{&commands[i], score})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score > matches[j].score
+		}
+		return matches[i].cmd.name < matches[j].cmd.name
+	})
+	cmds := make([]*Command, len(matches))
+	for i, m := range matches {
+		cmds[i] = m.cmd
+	}
+	return cmds
+}
+
+func (e *Editor) toCommandMode() {
+	e.miscBuf.New("", e.log)
+	e.render.miscBufRender.Reset()
+	e.mode = CommandMode
+	e.promptHist.Reset(e.mode)
+	e.cmdMatches = matchCommands("")
+	e.cmdSelected = 0
+}
+
+func (e *Editor) processCommandMode() {
+	switch e.key.op {
+	case ExitOp:
+		e.Exit()
+	case CancelOp:
+		e.mode = EditMode
+		e.setMsg("Command cancelled")
+	case MoveCursorUpOp:
+		if e.cmdSelected > 0 {
+			e.cmdSelected--
+		}
+	case MoveCursorDownOp:
+		if e.cmdSelected < len(e.cmdMatches)-1 {
+			e.cmdSelected++
+		}
+	case InsertTabOp:
+		if len(e.cmdMatches) > 0 {
+			e.miscBuf.New("", e.log)
+			e.miscBuf.InsertString(e.cmdMatches[e.cmdSelected].name)
+			e.cmdMatches = matchCommands(e.getPromptInput())
+			e.cmdSelected = 0
+		}
+	case InsertEnterOp:
+		if len(e.cmdMatches) == 0 {
+			e.setMsg(fmt.Sprintf("No command matches %s", e.getPromptInput()))
+			e.mode = EditMode
+			return
+		}
+		cmd := e.cmdMatches[e.cmdSelected]
+		e.promptHist.Add(e.mode, cmd.name)
+		e.runCommand(cmd)
+	default:
+		if e.processPromptKey() {
+			e.cmdMatches = matchCommands(e.getPromptInput())
+			e.cmdSelected = 0
+		}
+	}
+}
+
+func (e *Editor) processCommandArgMode() {
+	switch e.key.op {
+	case ExitOp:
+		e.Exit()
+	case CancelOp:
+		e.mode = EditMode
+		e.setMsg("Command cancelled")
+	case InsertEnterOp:
+		input := e.getPromptInput()
+		e.promptHist.Add(e.mode, input)
+		e.mode = EditMode
+		if err := e.cmdPending.run(e, input); err != nil {
+			e.setMsg(fmt.Sprintf("%s: %s", e.cmdPending.name, err))
+		}
+	default:
+		e.processPromptKey()
+	}
+}
+
+// Run a command in the mode of current buffer, an operation is handled as
+// if its key was pressed
+func (e *Editor) runCommand(cmd *Command) {
+	e.mode = EditMode
+	e.identifyFileMode()
+	if cmd.run != nil {
+		if cmd.prompt == "" {
+			if err := cmd.run(e, ""); err != nil {
+				e.setMsg(fmt.Sprintf("%s: %s", cmd.name, err))
+			}
+			return
+		}
+		e.cmdPending = cmd
+		e.miscBuf.New("", e.log)
+		e.render.miscBufRender.Reset()
+		e.mode = CommandArgMode
+		e.promptHist.Reset(e.mode)
+		return
+	}
+	e.setMsg("")
+	e.key.op = cmd.op
+	e.key.ch = 0
+	event := tm.Event{Type: tm.EventKey}
+	switch e.mode {
+	case EditMode:
+		e.processEditModeKey()
+	case DirMode:
+		e.processDirMode(event)
+	case HexMode:
+		e.processHexMode(event)
+	}
+}
+
+// Return the prompt of a command argument, or what the encoding prompt does
+func (e *Editor) getCommandPrompt() string {
+	switch e.mode {
+	case CommandArgMode:
+		return e.cmdPending.prompt
+	case EncodingMode:
+		if e.saveEncoding {
+			return "Save in encoding"
+		}
+		return "Reopen in encoding"
+	}
+	return ""
+}
+
+// Return matched commands as lines of the palette with their keys, the
+// selected one is at index selected of the returned lines
+func (e *Editor) getCommandCandidates() ([]string, int) {
+	if e.mode != CommandMode {
+		return nil, 0
+	}
+	start := 0
+	if e.cmdSelected >= COMMAND_CANDIDATES {
+		start = e.cmdSelected - COMMAND_CANDIDATES + 1
+	}
+	end := start + COMMAND_CANDIDATES
+	if end > len(e.cmdMatches) {
+		end = len(e.cmdMatches)
+	}
+	lines := []string{}
+	for _, cmd := range e.cmdMatches[start:end] {
+		keys := ""
+		if cmd.run == nil {
+			keys = e.key.keymap.getKeys(cmd.op)
+		}
+		lines = append(lines, fmt.Sprintf("%-22s %-10s %s", cmd.name, keys, cmd.desc))
+	}
+	return lines, e.cmdSelected - start
+}
@@ -1,8 +1,37 @@
 package pine
 
 const (
-	VERSION  = "0.2.6 alpha"
-	TABWIDTH = 4
+	VERSION       = "0.2.6 alpha"
+	TABWIDTH      = 4
+	MAX_TABWIDTH  = 16
+	KILLRING_SIZE = 16
+	HISTORY_SIZE  = 100
+	// File loading
+	READ_BUFFER_SIZE    = 1 << 20
+	LARGE_FILE_SIZE     = 16 << 20
+	LOAD_PROGRESS_STEPS = 20
+	ENCODING_SNIFF_LEN  = 64 << 10
+	GBK_MIN_PAIRS       = 2
+	// Hex mode
+	HEX_ROW_LEN      = 16
+	HEX_OFFSET_WIDTH = 8
+	// Swap file
+	SWAP_IDLE_MS = 2000
+	SWAP_EDITS   = 100
+	// External change
+	DISK_CHECK_MS = 3000
+	// Diff
+	DIFF_MAX_CELLS = 4 << 20
+	// Command palette
+	COMMAND_CANDIDATES = 8
+	// Keyboard macro
+	MACRO_MAX_RUNS = 1000
+	// Numeric prefix
+	MAX_PREFIX_ARG = 10000
+	// Grep
+	GREP_BATCH_SIZE  = 200
+	GREP_BATCH_QUEUE = 16
+	BINARY_SNIFF_LEN = 8000
 )
 
 type Mode int64
@@ -11,6 +40,17 @@ const (
 	DEFAULT_BUFFERNAME     = "untitled"
 	DEFAULT_CURR_BUF_INDEX = 0
 	HELP_DOC_PATH          = "/usr/local/share/doc/pe/help.txt"
+	DEFAULT_LOG_PATH       = "~/.pe.log"
+	CONFIG_FILENAME        = "config"
+	KEYMAP_FILENAME        = "keymap"
+	HISTORY_FILENAME       = "history"
+	GREP_BUFFERNAME        = "*grep*"
+	STDIN_BUFFERNAME       = "*stdin*"
+	STDIN_PATH             = "-"
+	SWAP_DIRNAME           = "swap"
+	SWAP_FILE_SUFFIX       = ".pe-swp"
+	SWAP_DIFF_BUFFERNAME   = "*swap-diff*"
+	MACRO_DIRNAME          = "macros"
 )
 
 // UI
@@ -28,8 +68,28 @@ const (
 	FileSaveMode
 	DirMode
 	SearchMode
+	GoToLineMode
+	EncodingMode
+	HexMode
+	ReplaceMode
+	ReplaceWithMode
+	QueryReplaceMode
+	GrepMode
+	CommandMode
+	CommandArgMode
 	ConfirmExitOp
 	ConfirmCloseOp
+	ConfirmRecoverOp
+	ConfirmReloadOp
+	ConfirmOverwriteOp
+)
+
+type HighlightStyle int64
+
+const (
+	RegionHighlight HighlightStyle = iota
+	MatchHighlight
+	CurrMatchHighlight
 )
 
 type FileOpMode int64
@@ -46,6 +106,7 @@ const (
 	IsDir
 	HasError
 	NotFound
+	ReadError
 )
 
 type KeyOps int64
@@ -65,6 +126,8 @@ const (
 	MoveCursorDownOp
 	MoveCursorLeftOp
 	MoveCursorRightOp
+	ForwardWordOp
+	BackwardWordOp
 	NextHalfPageOp
 	PrevHalfPageOp
 	// of the line
@@ -73,18 +136,53 @@ const (
 	// of the document
 	GoToBODOp
 	GoToEODOp
+	GoToLineOp
+	// View
+	ToggleWrapOp
 	// Text Edit Ops
 	InsertChOp
 	InsertSpaceOp
 	InsertTabOp
 	InsertEnterOp
 	DeleteChOp
+	DeleteForwardChOp
+	KillWordOp
+	BackwardKillWordOp
 	DeleteLineOp
+	ToggleLineEndingOp
+	ReopenEncodingOp
+	SaveEncodingOp
+	// History
+	UndoOp
+	RedoOp
+	// Region and kill ring
+	SetMarkOp
+	KillRegionOp
+	CopyRegionOp
+	YankOp
+	YankPopOp
 	// Search
 	SearchOp
 	SearchNextOp
 	SearchPrevOp
+	ReplaceOp
+	ReplaceAllOp
+	ToggleCaseOp
+	ToggleLiteralOp
+	ToggleWordOp
+	GrepOp
+	// Prompt
+	HistoryPrevOp
+	HistoryNextOp
+	// Keyboard macro
+	StartMacroOp
+	StopMacroOp
+	RunMacroOp
+	// Numeric prefix
+	UniversalArgOp
+	DigitArgOp
 	// Misc
 	CmdOp
+	CommandOp
 	CancelOp
 )
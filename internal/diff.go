@@ -0,0 +1,71 @@
+package pine
+
+// Return a line diff of a and b, unchanged lines start with "  ", removed lines
+// with "- " and added lines with "+ "
+// The longest common subsequence table takes len(a)*len(b) cells, larger input
+// is shown as a whole removal and addition
+func diffLines(a, b []string) []string {
+	// Common head and tail are kept out of the table
+	head := 0
+	for head < len(a) && head < len(b) && a[head] == b[head] {
+		head++
+	}
+	tail := 0
+	for tail < len(a)-head && tail < len(b)-head && a[len(a)-1-tail] == b[len(b)-1-tail] {
+		tail++
+	}
+	result := []string{}
+	for _, txt := range a[:head] {
+		result = append(result, "  "+txt)
+	}
+	result = append(result, diffMiddle(a[head:len(a)-tail], b[head:len(b)-tail])...)
+	for _, txt := range a[len(a)-tail:] {
+		result = append(result, "  "+txt)
+	}
+	return result
+}
+
+func diffMiddle(a, b []string) []string {
+	result := []string{}
+	if len(a)*len(b) > DIFF_MAX_CELLS {
+		for _, txt := range a {
+			result = append(result, "- "+txt)
+		}
+		for _, txt := range b {
+			result = append(result, "+ "+txt)
+		}
+		return result
+	}
+	// lcs[i][j] is the common subsequence length of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			result = append(result, "  "+a[i])
+			i++
+			j++
+		case j >= len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			result = append(result, "- "+a[i])
+			i++
+		default:
+			result = append(result, "+ "+b[j])
+			j++
+		}
+	}
+	return result
+}
@@ -0,0 +1,78 @@
+package pine
+
+import (
+	"crypto/sha256"
+	"io"
+	"os"
+	"time"
+)
+
+// diskState is the file on disk as last loaded or saved by the buffer
+// Hash is only compared when modification time or size changes
+type diskState struct {
+	modTime time.Time
+	size    int64
+	hash    [sha256.Size]byte
+}
+
+// Record the file state after its content with the given hash is loaded or saved
+func (b *Buffer) recordDiskState(hash []byte) {
+	stat, err := os.Stat(b.filePath)
+	if err != nil {
+		b.disk = diskState{}
+		return
+	}
+	b.disk = diskState{modTime: stat.ModTime(), size: stat.Size()}
+	copy(b.disk.hash[:], hash)
+}
+
+// Check if the file has been changed on disk by another program since the
+// last check, a file touched without content change is not a change
+func (b *Buffer) checkDisk() bool {
+	if !b.hasFile() {
+		return false
+	}
+	stat, err := os.Stat(b.filePath)
+	if err != nil || !stat.Mode().IsRegular() {
+		return false
+	}
+	if stat.ModTime().Equal(b.disk.modTime) && stat.Size() == b.disk.size {
+		return false
+	}
+	f, err := os.Open(b.filePath)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return false
+	}
+	state := diskState{modTime: stat.ModTime(), size: stat.Size()}
+	copy(state.hash[:], h.Sum(nil))
+	changed := state.hash != b.disk.hash
+	b.disk = state
+	if changed {
+		b.diskChanged = true
+		b.askReload = true
+	}
+	return changed
+}
+
+// Load the file again, changes in buffer are discarded
+func (b *Buffer) reload() FileOpenState {
+	cursor := *b.cursor
+	b.init(b.log)
+	b.crlf, b.bom, b.noEOL = false, false, false
+	b.isHex, b.hexASCII, b.data = false, false, nil
+	state := b.openFile(b.filePath)
+	if !b.isHex {
+		*b.cursor = b.clampPos(cursor)
+	} else if cursor.x < len(b.data) {
+		*b.cursor = Pos{cursor.x, 0}
+	}
+	b.edits++
+	b.diskChanged = false
+	b.askReload = false
+	return state
+}
@@ -3,49 +3,104 @@ package pine
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	tm "github.com/nsf/termbox-go"
 )
 
+// yankStart is where the last yanked text starts, used by yank pop
+// lastKillLine is the line index of the last line kill, used to join consecutive kills
+// swapTimer fires when editing pauses and sends to swapDue to write swap files
+// diskTimer sends to diskDue to check files changed by other programs
+// recoverBuf is the buffer asking what to do with its leftover swap file
+// savePath is the path waiting for confirmation to overwrite a newer file
+// saveEncoding tells if the encoding prompt converts the buffer on save
+// instead of reopening the file
 type Editor struct {
-	bufIdx  int
-	bufs    []*Buffer
-	miscBuf *Buffer
-	render  Render
-	search  Search
-	mode    Mode
-	sett    *Setting
-	log     *log.Logger
-	key     *KeyMapper
-	isExit  bool
+	bufIdx       int
+	bufs         []*Buffer
+	miscBuf      *Buffer
+	render       Render
+	search       Search
+	replace      Replace
+	promptHist   PromptHistory
+	grep         *Grep
+	swapTimer    *time.Timer
+	swapDue      chan struct{}
+	diskTimer    *time.Timer
+	diskDue      chan struct{}
+	recoverBuf   *Buffer
+	savePath     string
+	saveEncoding bool
+	kills        KillRing
+	yankStart    Pos
+	lastKillLine int
+	mode         Mode
+	sett         *Setting
+	initErrs     []error
+	cmdMatches   []*Command
+	cmdSelected  int
+	cmdPending   *Command
+	macro        Macro
+	playing      bool
+	failed       bool
+	log          *log.Logger
+	key          *KeyMapper
+	isExit       bool
 }
 
 type Pos struct {
 	x, y int
 }
 
+// FileArg is a file given on command line
+// Line and Col are 1 based, 0 if not given
+type FileArg struct {
+	Path string
+	Line int
+	Col  int
+}
+
+// Config file is loaded into sett, options set on command line are kept
 func (e *Editor) Init(sett *Setting) {
 	e.sett = sett
+	if path, err := getConfigPath(CONFIG_FILENAME); err == nil {
+		e.initErrs = sett.Load(path)
+	}
+	tabWidth = sett.TabWidth
 	e.log = e.initLogger()
+	for _, err := range e.initErrs {
+		e.log.Errorf("config: %v", err)
+	}
 	e.isExit = false
 	e.miscBuf = &Buffer{}
 	e.render.Init(sett, e.log)
 	e.search = Search{log: e.log}
-	e.key = &KeyMapper{}
+	e.replace = Replace{log: e.log}
+	e.promptHist = PromptHistory{log: e.log}
+	e.promptHist.Load()
+	e.key = NewKeyMapper()
+	if path, err := getConfigPath(KEYMAP_FILENAME); err == nil {
+		for _, err := range e.key.keymap.Load(path) {
+			e.log.Errorf("keymap: %v", err)
+			e.initErrs = append(e.initErrs, err)
+		}
+	}
 	e.bufIdx = DEFAULT_CURR_BUF_INDEX
 	e.bufs = []*Buffer{}
 }
 
 func (e *Editor) initLogger() *log.Logger {
 	logger := log.New()
-	logger.Level = log.ErrorLevel
+	logger.Level, _ = log.ParseLevel(e.sett.LogLevel)
 	if e.sett.IsDebug {
 		logger.Level = log.DebugLevel
 	}
-	logFilepath := "~/.pe.log"
-	logFilepath, err := expandHomeDir(logFilepath)
+	logFilepath, err := expandHomeDir(e.sett.LogFile)
 	if err != nil {
 		logger.Fatalf("failed to setup logger: %v", err)
 	}
@@ -59,19 +114,52 @@ func (e *Editor) initLogger() *log.Logger {
 	return logger
 }
 
-func (e *Editor) Start(path string) {
+// Files are opened before termbox takes the terminal, so that piped stdin is
+// read to the end first, termbox itself reads keys from /dev/tty
+func (e *Editor) Start(files []FileArg) {
+	e.openFiles(files)
+	if len(e.initErrs) > 0 {
+		e.setMsg(fmt.Sprintf("%v, see log for details", e.initErrs[0]))
+	}
+
 	err := tm.Init()
-	tm.SetInputMode(tm.InputMouse)
 	if err != nil {
 		panic(err)
 	}
+	if e.sett.Mouse {
+		tm.SetInputMode(tm.InputAlt | tm.InputMouse)
+	} else {
+		tm.SetInputMode(tm.InputAlt)
+	}
 	defer tm.Close()
+	// Keep unsaved changes in swap files if the editor crashes
+	defer func() {
+		if r := recover(); r != nil {
+			e.writeSwaps()
+			panic(r)
+		}
+	}()
 
-	e.Open(path, -1)
+	e.swapDue = make(chan struct{}, 1)
+	e.swapTimer = startTimer(e.swapDue, SWAP_IDLE_MS)
+	defer e.swapTimer.Stop()
+	e.diskDue = make(chan struct{}, 1)
+	e.diskTimer = startTimer(e.diskDue, DISK_CHECK_MS)
+	defer e.diskTimer.Stop()
+
+	e.checkSwap()
 	e.renderAll()
+	// View size is only known after the first render
+	if len(files) > 0 && files[0].Line > 0 {
+		e.render.bufRender.CenterCursor(e.getBuf())
+		e.renderAll()
+	}
 	for !e.isExit {
 		e.process()
 	}
+	for _, buf := range e.bufs {
+		buf.removeSwap()
+	}
 
 	e.render.Clear()
 	tm.Flush()
@@ -79,10 +167,41 @@ func (e *Editor) Start(path string) {
 
 func (e *Editor) process() {
 	event := tm.PollEvent()
+	if event.Type == tm.EventInterrupt {
+		e.processGrepResults()
+		select {
+		case <-e.swapDue:
+			e.writeSwaps()
+		default:
+		}
+		select {
+		case <-e.diskDue:
+			e.checkDisks()
+			e.diskTimer.Reset(DISK_CHECK_MS * time.Millisecond)
+		default:
+		}
+		e.checkReload()
+		e.renderAll()
+		return
+	}
+	e.processEvent(event)
+}
+
+// Handle a key or mouse event, events of a keyboard macro are played here
+// and rendering waits until the macro finishes, only the view is kept in sync
+// with cursor, played events are not recorded again
+func (e *Editor) processEvent(event tm.Event) {
 	if event.Type != tm.EventKey && event.Type != tm.EventMouse {
 		return
 	}
-	e.key.Map(event)
+	if e.macro.recording && !e.playing && event.Type == tm.EventKey {
+		e.macro.Record(event, e.key.Pending() == "" && !isMiscMode(e.mode))
+	}
+	e.key.Map(event, e.mode)
+	if isConfirmMode(e.mode) {
+		// The answer is read from the key, it must not start a key sequence
+		e.key.ClearPending()
+	}
 	if e.mode == ConfirmExitOp {
 		if event.Key == tm.KeyCtrlX {
 			e.isExit = true
@@ -92,11 +211,23 @@ func (e *Editor) process() {
 		e.setMsg("Exit cancelled")
 	} else if e.mode == ConfirmCloseOp {
 		if event.Ch == rune('y') {
+			e.getBuf().removeSwap()
 			e.bufs = append(e.bufs[:e.bufIdx], e.bufs[e.bufIdx+1:]...)
 			e.nextBuffer()
 		}
 		e.mode = EditMode
 		e.setMsg("")
+	} else if e.mode == ConfirmRecoverOp {
+		e.processRecoverMode(event)
+	} else if e.mode == ConfirmReloadOp {
+		e.processReloadMode(event)
+	} else if e.mode == ConfirmOverwriteOp {
+		if event.Ch == rune('y') {
+			e.saveFile(e.savePath)
+		} else {
+			e.mode = EditMode
+			e.setMsg("Save cancelled")
+		}
 	} else {
 		e.identifyFileMode()
 		switch e.mode {
@@ -108,8 +239,26 @@ func (e *Editor) process() {
 			e.processSaveFileMode(e.getBuf().filePath)
 		case DirMode:
 			e.processDirMode(event)
+		case HexMode:
+			e.processHexMode(event)
 		case SearchMode:
 			e.processSearchMode()
+		case GoToLineMode:
+			e.processGoToLineMode()
+		case EncodingMode:
+			e.processEncodingMode()
+		case ReplaceMode:
+			e.processReplaceMode()
+		case ReplaceWithMode:
+			e.processReplaceWithMode()
+		case QueryReplaceMode:
+			e.processQueryReplaceMode()
+		case GrepMode:
+			e.processGrepMode()
+		case CommandMode:
+			e.processCommandMode()
+		case CommandArgMode:
+			e.processCommandArgMode()
 		default:
 			e.log.Fatal("unsupported edit mode")
 		}
@@ -119,15 +268,168 @@ func (e *Editor) process() {
 		return
 	}
 	e.identifyFileMode()
-	e.renderAll()
+	e.autosave()
+	e.checkSwap()
+	e.checkReload()
+	e.getBuf().syncRegionHighlight()
+	if e.playing {
+		e.render.SyncView(e.getRenderContent())
+	} else {
+		e.renderAll()
+	}
+}
+
+func isConfirmMode(mode Mode) bool {
+	switch mode {
+	case ConfirmExitOp, ConfirmCloseOp, ConfirmRecoverOp, ConfirmReloadOp, ConfirmOverwriteOp:
+		return true
+	}
+	return false
+}
+
+// Return a timer which sends to due and wakes the editor loop up after ms
+func startTimer(due chan struct{}, ms int) *time.Timer {
+	return time.AfterFunc(time.Duration(ms)*time.Millisecond, func() {
+		select {
+		case due <- struct{}{}:
+		default:
+		}
+		tm.Interrupt()
+	})
+}
+
+// Write swap files of buffers changed SWAP_EDITS times, others are written
+// when editing pauses for SWAP_IDLE_MS
+func (e *Editor) autosave() {
+	for _, buf := range e.bufs {
+		if buf.edits-buf.swapEdits >= SWAP_EDITS {
+			e.writeSwap(buf)
+		}
+	}
+	e.swapTimer.Reset(SWAP_IDLE_MS * time.Millisecond)
+}
+
+func (e *Editor) writeSwaps() {
+	for _, buf := range e.bufs {
+		e.writeSwap(buf)
+	}
+}
+
+func (e *Editor) writeSwap(buf *Buffer) {
+	if err := buf.writeSwap(); err != nil {
+		e.log.Warnf("failed to write swap file of %s: %v", buf.filePath, err)
+	}
+}
+
+// Ask what to do with the leftover swap file of the current buffer
+func (e *Editor) checkSwap() {
+	if e.mode != EditMode || !e.getBuf().pendingSwap {
+		return
+	}
+	e.recoverBuf = e.getBuf()
+	e.mode = ConfirmRecoverOp
+	e.setMsg(fmt.Sprintf("Swap file found for %s: r recover, d diff, x delete, other key open read only", getFilename(e.recoverBuf.filePath)))
+}
+
+func (e *Editor) checkDisks() {
+	for _, buf := range e.bufs {
+		buf.checkDisk()
+	}
+}
+
+// Ask whether to reload the current buffer after its file changed on disk
+func (e *Editor) checkReload() {
+	if (e.mode != EditMode && e.mode != HexMode) || !e.getBuf().askReload {
+		return
+	}
+	e.mode = ConfirmReloadOp
+	name := getFilename(e.getBuf().filePath)
+	if e.getBuf().dirty {
+		e.setMsg(fmt.Sprintf("%s changed on disk: r reload and discard changes, other key keep buffer", name))
+	} else {
+		e.setMsg(fmt.Sprintf("%s changed on disk: r reload, other key keep buffer", name))
+	}
+}
+
+// r reloads the file, any other key keeps the buffer and saving it asks
+// before overwriting the newer file
+func (e *Editor) processReloadMode(event tm.Event) {
+	buf := e.getBuf()
+	buf.askReload = false
+	e.mode = EditMode
+	if event.Ch != rune('r') {
+		e.setMsg("Buffer kept, file on disk is newer")
+		return
+	}
+	if state := buf.reload(); state != Success {
+		e.setMsg(fmt.Sprintf("Unable to reload %s", buf.filePath))
+		return
+	}
+	e.setMsg(fmt.Sprintf("Reloaded %s", buf.filePath))
+}
+
+// r recovers the swap file, d shows its diff to the file, x deletes it and any
+// other key opens the file read only and keeps the swap file
+func (e *Editor) processRecoverMode(event tm.Event) {
+	buf := e.recoverBuf
+	for idx := range e.bufs {
+		if e.bufs[idx] == buf {
+			e.bufIdx = idx
+		}
+	}
+	switch event.Ch {
+	case rune('r'):
+		if err := buf.recoverSwap(); err != nil {
+			e.log.Errorf("failed to recover %s: %v", buf.filePath, err)
+			e.setMsg(fmt.Sprintf("Unable to recover swap file: %s", err))
+			return
+		}
+		e.setMsg("Recovered from swap file, save to keep the changes")
+	case rune('d'):
+		e.showSwapDiff(buf)
+		return
+	case rune('x'):
+		buf.discardSwap()
+		e.setMsg("Swap file deleted")
+	default:
+		buf.pendingSwap = false
+		buf.readOnly = true
+		e.setMsg("Opened read only, swap file is kept")
+	}
+	e.recoverBuf = nil
+	e.mode = EditMode
+}
+
+// Show diff from the file to its swap file in a read-only buffer
+func (e *Editor) showSwapDiff(buf *Buffer) {
+	lines, err := buf.diffSwap()
+	if err != nil {
+		e.setMsg(fmt.Sprintf("Unable to diff swap file: %s", err))
+		return
+	}
+	diff := &Buffer{}
+	diff.New("", e.log)
+	diff.filePath = SWAP_DIFF_BUFFERNAME
+	diff.readOnly = true
+	diff.appendLines(lines)
+	if idx := e.hasFileOpened(diff.filePath); idx >= 0 {
+		e.bufs[idx] = diff
+		e.bufIdx = idx
+	} else {
+		e.bufs = append(e.bufs, diff)
+		e.bufIdx = len(e.bufs) - 1
+	}
+	e.setMsg(fmt.Sprintf("Diff to swap file of %s: r recover, x delete, other key open read only", getFilename(buf.filePath)))
 }
 
 func (e *Editor) identifyFileMode() {
-	if e.isExit || (e.mode != EditMode && e.mode != DirMode) {
+	if e.isExit || (e.mode != EditMode && e.mode != DirMode && e.mode != HexMode) {
 		return
 	}
 	if e.getBuf().isDir {
 		e.mode = DirMode
+	} else if e.getBuf().isHex {
+		e.mode = HexMode
 	} else {
 		e.mode = EditMode
 	}
@@ -140,14 +442,13 @@ func (e *Editor) processOpenFileMode() {
 	case CancelOp:
 		e.mode = EditMode
 		e.setMsg("Open file cancelled")
-	case DeleteChOp:
-		e.miscBuf.Delete()
 	case InsertEnterOp:
-		if len(e.miscBuf.lines) > 0 && len(e.miscBuf.lines[0].txt) > 0 {
-			e.Open(string(e.miscBuf.lines[0].txt), -1)
+		if input := e.getPromptInput(); input != "" {
+			e.promptHist.Add(e.mode, input)
+			e.Open(input, -1)
 		}
-	case InsertChOp:
-		e.miscBuf.Insert(e.key.ch)
+	default:
+		e.processPromptKey()
 	}
 }
 
@@ -158,46 +459,61 @@ func (e *Editor) processSaveFileMode(filepath string) {
 	case CancelOp:
 		e.mode = EditMode
 		e.setMsg("Save file cancelled")
-	case DeleteChOp:
-		e.miscBuf.Delete()
 	case InsertEnterOp:
-		if len(e.miscBuf.lines) > 0 && len(e.miscBuf.lines[0].txt) > 0 {
-			e.Save(string(e.miscBuf.lines[0].txt))
+		if input := e.getPromptInput(); input != "" {
+			e.promptHist.Add(e.mode, input)
+			e.Save(input)
 		}
-	case InsertChOp:
-		e.miscBuf.Insert(e.key.ch)
+	default:
+		e.processPromptKey()
 	}
 }
 
+// Search runs on every change of the pattern and jumps to the nearest match
+// from where the search started. Enter stays at the match, ^G goes back
 func (e *Editor) processSearchMode() {
-	target := ""
-	if !e.miscBuf.isEmpty() {
-		target = string(e.miscBuf.lines[0].txt)
-	}
+	buf := e.getBuf()
 	switch e.key.op {
 	case ExitOp:
 		e.Exit()
 	case CancelOp:
-		e.getBuf().ResetHightlight()
+		buf.ResetHightlight()
+		*buf.cursor = e.search.startPos
 		e.mode = EditMode
-	case DeleteChOp:
-		e.miscBuf.Delete()
+		e.setMsg("Search cancelled")
 	case InsertEnterOp:
-		e.search.Search(string(e.miscBuf.lines[0].txt), e.getBuf())
-		if len(e.search.matchedStartPos) > 0 {
-			e.search.currCandidateIdx = 0
-			e.search.SetBufferHightlight(e.getBuf(), target)
+		e.promptHist.Add(e.mode, e.getPromptInput())
+		e.search.lastTarget = e.getPromptInput()
+		// A search which wraps around to before its start fails, so that a
+		// keyboard macro stops at the last match
+		idx := e.search.currCandidateIdx
+		if idx < 0 || isPosBefore(*e.search.matchedStartPos[idx], e.search.startPos) {
+			e.failed = true
 		}
-	case MoveCursorDownOp, MoveCursorRightOp:
+		buf.ResetHightlight()
+		e.mode = EditMode
+		e.setMsg(fmt.Sprintf("Search: %s", e.search.Status()))
+	case ToggleCaseOp:
+		e.search.ToggleIgnoreCase()
+		e.incrementalSearch()
+	case ToggleLiteralOp:
+		e.search.ToggleLiteral()
+		e.incrementalSearch()
+	case ToggleWordOp:
+		e.search.ToggleWholeWord()
+		e.incrementalSearch()
+	case MoveCursorDownOp, MoveCursorRightOp, SearchOp:
 		if len(e.search.matchedStartPos) <= 0 {
+			e.failed = true
 			return
 		}
 		if e.search.currCandidateIdx < len(e.search.matchedStartPos)-1 {
 			e.search.currCandidateIdx++
 		} else {
 			e.search.currCandidateIdx = 0
+			e.failed = true
 		}
-		e.search.SetBufferHightlight(e.getBuf(), target)
+		e.search.SetBufferHightlight(buf, e.getPromptInput())
 	case MoveCursorUpOp, MoveCursorLeftOp:
 		if len(e.search.matchedStartPos) <= 0 {
 			return
@@ -207,12 +523,393 @@ func (e *Editor) processSearchMode() {
 		} else {
 			e.search.currCandidateIdx = len(e.search.matchedStartPos) - 1
 		}
-		e.search.SetBufferHightlight(e.getBuf(), target)
+		e.search.SetBufferHightlight(buf, e.getPromptInput())
+	default:
+		if e.processPromptKey() {
+			e.incrementalSearch()
+		}
+	}
+}
+
+// Go to the next or previous match of the last search from cursor, a search
+// which wraps around fails as in search mode
+func (e *Editor) searchAgain(forward bool) {
+	buf := e.getBuf()
+	target := e.search.lastTarget
+	if target == "" {
+		e.setMsg("No previous search")
+		e.failed = true
+		return
+	}
+	from := *buf.cursor
+	e.search.Search(target, buf)
+	matches := e.search.matchedStartPos
+	if len(matches) == 0 {
+		e.setMsg(fmt.Sprintf("Search: no match for %s", target))
+		e.failed = true
+		return
+	}
+	idx := -1
+	for i, p := range matches {
+		if forward && isPosBefore(from, *p) {
+			idx = i
+			break
+		}
+		if !forward && isPosBefore(*p, from) {
+			idx = i
+		}
+	}
+	wrapped := idx < 0
+	if wrapped && forward {
+		idx = 0
+	} else if wrapped {
+		idx = len(matches) - 1
+	}
+	e.search.currCandidateIdx = idx
+	*buf.cursor = *matches[idx]
+	if wrapped {
+		e.failed = true
+		e.setMsg(fmt.Sprintf("Search wrapped: %s", e.search.Status()))
+		return
+	}
+	e.setMsg(fmt.Sprintf("Search: %s", e.search.Status()))
+}
+
+func (e *Editor) processGoToLineMode() {
+	switch e.key.op {
+	case ExitOp:
+		e.Exit()
+	case CancelOp:
+		e.mode = EditMode
+		e.setMsg("Go to line cancelled")
+	case InsertEnterOp:
+		input := e.getPromptInput()
+		p, err := parseGoToLine(input, e.getBuf())
+		if err != nil {
+			e.setMsg(fmt.Sprintf("Go to line: %s", err))
+			return
+		}
+		e.promptHist.Add(e.mode, input)
+		e.mode = EditMode
+		e.goTo(p)
+	default:
+		e.processPromptKey()
+	}
+}
+
+// The file is reopened in the encoding, which needs a buffer without changes,
+// or the buffer is converted to the encoding on save
+func (e *Editor) processEncodingMode() {
+	switch e.key.op {
+	case ExitOp:
+		e.Exit()
+	case CancelOp:
+		e.mode = EditMode
+		e.setMsg("Encoding cancelled")
+	case InsertEnterOp:
+		name := strings.ToLower(strings.TrimSpace(e.getPromptInput()))
+		if !isSupportedEncoding(name) {
+			e.setMsg(fmt.Sprintf("Unsupported encoding %s", name))
+			return
+		}
+		e.promptHist.Add(e.mode, name)
+		e.mode = EditMode
+		buf := e.getBuf()
+		if !e.saveEncoding {
+			if !buf.hasFile() {
+				e.setMsg("Buffer has no file to reopen")
+				return
+			}
+			if buf.dirty {
+				e.setMsg("Buffer has changes, save or undo them before reopening")
+				return
+			}
+			buf.encoding = name
+			if state := buf.reload(); state != Success {
+				e.setMsg(fmt.Sprintf("Unable to reopen %s in %s", buf.filePath, name))
+				return
+			}
+			e.setMsg(fmt.Sprintf("Reopened in %s", name))
+			return
+		}
+		if buf.readOnly {
+			e.setMsg("Buffer is read only")
+			return
+		}
+		buf.encoding = name
+		// UTF-16 is only detected by its BOM, other encodings but UTF-8 have none
+		buf.bom = name == UTF16LEEncoding || name == UTF16BEEncoding || (name == UTF8Encoding && buf.bom)
+		buf.history.markUnsaved()
+		buf.setDirty()
+		e.setMsg(fmt.Sprintf("Buffer is saved in %s", name))
+	default:
+		e.processPromptKey()
+	}
+}
+
+// Move cursor to the position and recentre the view on it
+func (e *Editor) goTo(p Pos) {
+	*e.getBuf().cursor = p
+	e.render.bufRender.CenterCursor(e.getBuf())
+	e.setMsg(fmt.Sprintf("Line %d, column %d", p.x+1, p.y+1))
+}
+
+func (e *Editor) incrementalSearch() {
+	buf := e.getBuf()
+	target := e.getPromptInput()
+	e.search.Search(target, buf)
+	if !e.search.SelectNearest(e.search.startPos) {
+		buf.ResetHightlight()
+		*buf.cursor = e.search.startPos
+		return
+	}
+	e.search.SetBufferHightlight(buf, target)
+}
+
+// Edit input of a prompt in the misc buffer, returns false if the key is not handled
+// Up and Down browse prompt history except in search mode, where they select matches
+func (e *Editor) processPromptKey() bool {
+	switch e.key.op {
+	case DeleteChOp:
+		e.miscBuf.Delete()
+	case DeleteForwardChOp:
+		e.miscBuf.DeleteForward()
+	case InsertSpaceOp:
+		e.miscBuf.Insert(rune(' '))
 	case InsertChOp:
 		e.miscBuf.Insert(e.key.ch)
+	case HistoryPrevOp:
+		e.recallPromptHistory(true)
+	case HistoryNextOp:
+		e.recallPromptHistory(false)
+	case MoveCursorUpOp:
+		if e.mode == SearchMode {
+			return false
+		}
+		e.recallPromptHistory(true)
+	case MoveCursorDownOp:
+		if e.mode == SearchMode {
+			return false
+		}
+		e.recallPromptHistory(false)
+	default:
+		return false
+	}
+	return true
+}
+
+func (e *Editor) recallPromptHistory(prev bool) {
+	input, ok := "", false
+	if prev {
+		input, ok = e.promptHist.Prev(e.mode, e.getPromptInput())
+	} else {
+		input, ok = e.promptHist.Next(e.mode)
+	}
+	if !ok {
+		return
+	}
+	e.miscBuf.New("", e.log)
+	e.miscBuf.InsertString(input)
+}
+
+func (e *Editor) getPromptInput() string {
+	if e.miscBuf.isEmpty() {
+		return ""
+	}
+	return string(e.miscBuf.lines[0].txt)
+}
+
+func (e *Editor) processReplaceMode() {
+	switch e.key.op {
+	case ExitOp:
+		e.Exit()
+	case CancelOp:
+		e.mode = EditMode
+		e.setMsg("Replace cancelled")
+	case InsertEnterOp:
+		if input := e.getPromptInput(); input != "" {
+			e.promptHist.Add(e.mode, input)
+			e.replace.target = input
+			e.miscBuf.New("", e.log)
+			e.render.miscBufRender.Reset()
+			e.mode = ReplaceWithMode
+			e.promptHist.Reset(e.mode)
+		}
+	default:
+		e.processPromptKey()
+	}
+}
+
+func (e *Editor) processReplaceWithMode() {
+	switch e.key.op {
+	case ExitOp:
+		e.Exit()
+	case CancelOp:
+		e.mode = EditMode
+		e.setMsg("Replace cancelled")
+	case InsertEnterOp:
+		template := e.getPromptInput()
+		e.promptHist.Add(e.mode, template)
+		if err := e.replace.Start(e.replace.target, template, e.getBuf(), e.replace.all); err != nil {
+			e.log.Warnf("failed to replace %s: %v", e.replace.target, err)
+			e.mode = EditMode
+			e.setMsg(fmt.Sprintf("Invalid pattern: %s", err))
+			return
+		}
+		if e.replace.all {
+			e.replace.ReplaceRest(e.getBuf())
+			e.finishReplace()
+			return
+		}
+		e.nextReplace()
+	default:
+		e.processPromptKey()
+	}
+}
+
+// Ask for each match: y replaces, n skips, ! replaces the rest, q quits
+func (e *Editor) processQueryReplaceMode() {
+	buf := e.getBuf()
+	switch e.key.op {
+	case ExitOp:
+		buf.ResetHightlight()
+		e.Exit()
+	case CancelOp, InsertEnterOp:
+		e.finishReplace()
+	case InsertSpaceOp:
+		e.replace.ReplaceCurr(buf)
+		e.nextReplace()
+	case InsertChOp:
+		switch e.key.ch {
+		case 'y':
+			e.replace.ReplaceCurr(buf)
+			e.nextReplace()
+		case 'n':
+			e.replace.SkipCurr()
+			e.nextReplace()
+		case '!':
+			e.replace.ReplaceRest(buf)
+			e.finishReplace()
+		case 'q':
+			e.finishReplace()
+		}
+	}
+}
+
+func (e *Editor) nextReplace() {
+	if !e.replace.Next(e.getBuf()) {
+		e.finishReplace()
+		return
+	}
+	e.mode = QueryReplaceMode
+	e.setMsg(fmt.Sprintf("Replace with \"%s\"? (y/n/!/q)", string(e.replace.matchRepl)))
+}
+
+func (e *Editor) finishReplace() {
+	e.getBuf().ResetHightlight()
+	e.mode = EditMode
+	e.setMsg(fmt.Sprintf("Replaced %d occurrences", e.replace.count))
+}
+
+func (e *Editor) processGrepMode() {
+	switch e.key.op {
+	case ExitOp:
+		e.Exit()
+	case CancelOp:
+		e.mode = EditMode
+		e.setMsg("Grep cancelled")
+	case InsertEnterOp:
+		if input := e.getPromptInput(); input != "" {
+			e.promptHist.Add(e.mode, input)
+			e.startGrep(input)
+		}
+	default:
+		e.processPromptKey()
+	}
+}
+
+// Search files under the directory of a Dir Mode buffer or the working directory
+// Results are collected into a read-only buffer while the walk is running
+func (e *Editor) startGrep(target string) {
+	root := e.getBuf().filePath
+	if !e.getBuf().isDir {
+		wd, err := os.Getwd()
+		if err != nil {
+			e.mode = EditMode
+			e.setMsg(fmt.Sprintf("Unable to grep: %s", err))
+			return
+		}
+		root = wd
+	}
+	if e.grep != nil {
+		e.grep.Stop()
+	}
+
+	search := Search{
+		ignoreCase: e.search.ignoreCase,
+		literal:    e.search.literal,
+		wholeWord:  e.search.wholeWord,
+		log:        e.log,
+	}
+	buf := &Buffer{}
+	buf.New("", e.log)
+	buf.filePath = filepath.Join(root, GREP_BUFFERNAME)
+	buf.readOnly = true
+	buf.isGrep = true
+	buf.appendLines([]string{fmt.Sprintf("Grep %s under %s", target, root)})
+	if idx := e.hasFileOpened(buf.filePath); idx >= 0 {
+		e.bufs[idx] = buf
+		e.bufIdx = idx
+	} else {
+		e.bufs = append(e.bufs, buf)
+		e.bufIdx = len(e.bufs) - 1
+	}
+	e.mode = EditMode
+
+	e.grep = &Grep{root: root, buf: buf, log: e.log}
+	e.grep.Start(search.compile(target), search)
+	e.setMsg(fmt.Sprintf("Grep %s under %s ...", target, root))
+}
+
+// Append ready grep results to the result buffer
+func (e *Editor) processGrepResults() {
+	if e.grep == nil {
+		return
+	}
+	for {
+		select {
+		case batch := <-e.grep.batches:
+			e.grep.buf.appendLines(batch.lines)
+			e.grep.count += len(batch.lines)
+			e.grep.files += batch.files
+			if batch.done {
+				e.grep.buf.appendLines([]string{fmt.Sprintf("%d matches in %d files", e.grep.count, e.grep.files)})
+				if !isMiscMode(e.mode) {
+					e.setMsg(fmt.Sprintf("Grep finished, %d matches", e.grep.count))
+				}
+				e.grep = nil
+				return
+			}
+		default:
+			return
+		}
 	}
 }
 
+// Open the file of the grep result under cursor and move cursor to the match
+func (e *Editor) openGrepResult() {
+	buf := e.getBuf()
+	if buf.isEmpty() || buf.cursor.x >= len(buf.lines) {
+		return
+	}
+	path, pos, ok := parseGrepResult(filepath.Dir(buf.filePath), string(buf.lines[buf.cursor.x].txt))
+	if !ok {
+		return
+	}
+	e.Open(path, -1)
+	*e.getBuf().cursor = e.getBuf().clampPos(pos)
+}
+
 func (e *Editor) processDirMode(event tm.Event) {
 	if event.Type == tm.EventKey {
 		if e.processCommonKey() {
@@ -243,10 +940,69 @@ func (e *Editor) processDirMode(event tm.Event) {
 	}
 }
 
+// Hex mode only overwrites bytes, the buffer size never changes
+func (e *Editor) processHexMode(event tm.Event) {
+	e.setMsg("")
+	buf := e.getBuf()
+	if event.Type != tm.EventKey {
+		if e.render.IsMousePointerOnBufferName(Pos{event.MouseY, event.MouseX}, buf.filePath, e.bufIdx) {
+			e.processMouseOnBufferName(event)
+		}
+		return
+	}
+	switch e.key.op {
+	case MoveCursorUpOp, MoveCursorDownOp, MoveCursorLeftOp, MoveCursorRightOp,
+		GoToBOLOp, GoToEOLOp, NextHalfPageOp, PrevHalfPageOp:
+		r := e.render.bufRender
+		buf.MoveHexCursor(e.key.op, (r.viewEndPos.x-r.viewStartPos.x)/2)
+	case InsertTabOp:
+		buf.ToggleHexColumn()
+	case InsertChOp, InsertSpaceOp:
+		ch := e.key.ch
+		if e.key.op == InsertSpaceOp {
+			ch = ' '
+		}
+		if buf.readOnly {
+			e.setMsg("Buffer is read only")
+		} else if !buf.HexOverwrite(ch) {
+			if buf.hexASCII {
+				e.setMsg("Not a printable ASCII character")
+			} else {
+				e.setMsg("Not a hex digit")
+			}
+		}
+	case UndoOp:
+		if !buf.Undo() {
+			e.setMsg("No further undo information")
+		}
+	case RedoOp:
+		if !buf.Redo() {
+			e.setMsg("No further redo information")
+		}
+	case SaveFileOp:
+		e.toSaveFileMode()
+	case ExitOp, OpenFileOp, CloseFileOp, HelpOp, NextBufferOp, PrevBufferOp, CmdOp, CommandOp,
+		StartMacroOp, StopMacroOp, RunMacroOp:
+		e.processCommonKey()
+	}
+}
+
+// A key op given a numeric prefix is repeated, until it changes mode
 func (e *Editor) processEditMode(event tm.Event) {
 	e.setMsg("")
 	if event.Type == tm.EventKey {
-		e.processEditModeKey()
+		count := e.key.count
+		if !isRepeatable(e.key.op) {
+			count = 1
+		}
+		for i := 0; i < count && e.mode == EditMode && !e.isExit; i++ {
+			if i > 0 {
+				e.render.SyncView(e.getRenderContent())
+			}
+			e.processEditModeKey()
+			// Repeated kills go to one kill ring entry
+			e.key.prevOp = e.key.op
+		}
 		return
 	}
 	e.processEditModeMouse(event)
@@ -274,19 +1030,68 @@ func (e *Editor) processEditModeKey() {
 			e.getBuf().NewLine()
 		case DeleteChOp:
 			e.getBuf().Delete()
+		case DeleteForwardChOp:
+			e.getBuf().DeleteForward()
+		case KillWordOp:
+			e.killWord(true)
+		case BackwardKillWordOp:
+			e.killWord(false)
 		case DeleteLineOp:
-			e.getBuf().DeleteLine()
+			e.killLine()
+		case KillRegionOp:
+			e.killRegion()
+		case YankOp:
+			e.yank()
+		case YankPopOp:
+			e.yankPop()
 		case InsertSpaceOp:
 			e.getBuf().Insert(rune(' '))
 		case InsertTabOp:
 			e.getBuf().InsertTab()
 		case InsertChOp:
 			e.getBuf().Insert(e.key.ch)
+		case UndoOp:
+			if !e.getBuf().Undo() {
+				e.setMsg("No further undo information")
+			}
+		case RedoOp:
+			if !e.getBuf().Redo() {
+				e.setMsg("No further redo information")
+			}
+		case ToggleLineEndingOp:
+			e.getBuf().ToggleLineEnding()
+			e.setMsg(fmt.Sprintf("Line ending converted to %s", e.getBuf().getLineEndingName()))
 		}
 	}
 	switch e.key.op {
 	case SaveFileOp:
 		e.toSaveFileMode()
+	case InsertEnterOp:
+		if e.getBuf().isGrep {
+			e.openGrepResult()
+		}
+	case GoToBODOp:
+		*e.getBuf().cursor = Pos{0, 0}
+	case GoToEODOp:
+		e.moveCursorToEOD()
+	case SearchNextOp:
+		e.searchAgain(true)
+	case SearchPrevOp:
+		e.searchAgain(false)
+	case ForwardWordOp:
+		*e.getBuf().cursor = e.getBuf().getNextWordEnd(*e.getBuf().cursor)
+	case BackwardWordOp:
+		*e.getBuf().cursor = e.getBuf().getPrevWordStart(*e.getBuf().cursor)
+	case SetMarkOp:
+		e.getBuf().SetMark()
+		e.setMsg("Mark set")
+	case CopyRegionOp:
+		e.copyRegion()
+	case CancelOp:
+		if e.getBuf().hasMark() {
+			e.getBuf().ClearMark()
+			e.setMsg("Mark cleared")
+		}
 	}
 	e.processCommonKey()
 }
@@ -317,8 +1122,38 @@ func (e *Editor) processCommonKey() bool {
 		e.prevBuffer()
 	case SearchOp:
 		e.toSearchMode()
+	case GoToLineOp:
+		e.toGoToLineMode()
+	case ReopenEncodingOp:
+		e.toEncodingMode(false)
+	case SaveEncodingOp:
+		e.toEncodingMode(true)
+	case ReplaceOp:
+		e.toReplaceMode(false)
+	case ReplaceAllOp:
+		e.toReplaceMode(true)
+	case GrepOp:
+		e.toGrepMode()
+	case CommandOp:
+		e.toCommandMode()
+	case StartMacroOp:
+		e.startMacro()
+	case StopMacroOp:
+		e.stopMacro()
+	case RunMacroOp:
+		if e.macro.recording {
+			e.stopMacro()
+		} else {
+			e.runMacro(e.key.count)
+		}
+	case ToggleWrapOp:
+		if e.render.ToggleWrap() {
+			e.setMsg("Soft wrap enabled")
+		} else {
+			e.setMsg("Soft wrap disabled")
+		}
 	case CmdOp:
-		e.setMsg("Cmd Mod (^X) Triggered")
+		// Unfinished key sequence is shown in status line
 	default:
 		return false
 	}
@@ -368,10 +1203,107 @@ func (e *Editor) moveCursorToEOL() {
 	e.getBuf().cursor.y = len(e.getBuf().lines[e.getBuf().cursor.x].txt)
 }
 
+func (e *Editor) moveCursorToEOD() {
+	buf := e.getBuf()
+	if buf.isEmpty() {
+		*buf.cursor = Pos{0, 0}
+		return
+	}
+	x := len(buf.lines) - 1
+	*buf.cursor = Pos{x, len(buf.lines[x].txt)}
+}
+
+// Delete current line into the kill ring
+// Consecutive line kills are joined into one entry in buffer order
+func (e *Editor) killLine() {
+	buf := e.getBuf()
+	x := buf.cursor.x
+	txt := buf.DeleteLine()
+	if txt == nil {
+		return
+	}
+	txt = append(append([]rune{}, txt...), '\n')
+	if e.key.prevOp != DeleteLineOp {
+		e.kills.Push(txt)
+	} else if x < e.lastKillLine {
+		e.kills.Prepend(txt)
+	} else {
+		e.kills.Append(txt)
+	}
+	e.lastKillLine = x
+}
+
+// Kill to the end of next word or the start of previous word
+// Consecutive word kills are joined into one entry in buffer order
+func (e *Editor) killWord(forward bool) {
+	buf := e.getBuf()
+	start, end := *buf.cursor, buf.getNextWordEnd(*buf.cursor)
+	if !forward {
+		start, end = buf.getPrevWordStart(*buf.cursor), *buf.cursor
+	}
+	txt := buf.DeleteText(start, end)
+	if len(txt) == 0 {
+		return
+	}
+	switch {
+	case e.key.prevOp != KillWordOp && e.key.prevOp != BackwardKillWordOp:
+		e.kills.Push(txt)
+	case forward:
+		e.kills.Append(txt)
+	default:
+		e.kills.Prepend(txt)
+	}
+}
+
+func (e *Editor) killRegion() {
+	if !e.getBuf().hasMark() {
+		e.setMsg("The mark is not set now")
+		return
+	}
+	e.kills.Push(e.getBuf().KillRegion())
+}
+
+func (e *Editor) copyRegion() {
+	if !e.getBuf().hasMark() {
+		e.setMsg("The mark is not set now")
+		return
+	}
+	e.kills.Push(e.getBuf().CopyRegion())
+	e.setMsg("Region copied")
+}
+
+func (e *Editor) yank() {
+	txt := e.kills.Yank()
+	if txt == nil {
+		e.setMsg("Kill ring is empty")
+		return
+	}
+	e.yankStart = *e.getBuf().cursor
+	e.getBuf().InsertText(txt)
+}
+
+// Replace the text inserted by the last yank with an older kill ring entry
+func (e *Editor) yankPop() {
+	if e.key.prevOp != YankOp && e.key.prevOp != YankPopOp {
+		e.setMsg("Previous command was not a yank")
+		e.key.op = NoOp
+		return
+	}
+	buf := e.getBuf()
+	buf.beginEdit()
+	buf.DeleteText(e.yankStart, *buf.cursor)
+	buf.InsertText(e.kills.Rotate())
+	buf.endEdit()
+}
+
 // Try to open a given filepath in the target buffer
 // If no index is given, open it in the end of buffers
 // If filepath is invalid, create a new buffer
 func (e *Editor) Open(path string, bufIdx int) {
+	if path == STDIN_PATH {
+		e.openStdin()
+		return
+	}
 	fullPath, err := expandHomeDir(path)
 	if err != nil {
 		e.log.Warnf(fmt.Sprintf("buffer %d: invalid filepath: %s", e.bufIdx, err))
@@ -382,6 +1314,7 @@ func (e *Editor) Open(path string, bufIdx int) {
 	}
 	if idx := e.hasFileOpened(fullPath); idx >= 0 {
 		e.bufIdx = idx
+		e.getBuf().checkDisk()
 		e.log.Infof(fmt.Sprintf("buffer %d: file %s already opened", e.bufIdx, e.getBuf().filePath))
 	} else {
 		buf := &Buffer{}
@@ -391,32 +1324,145 @@ func (e *Editor) Open(path string, bufIdx int) {
 			e.bufs = append(e.bufs, buf)
 			e.bufIdx = len(e.bufs) - 1
 		}
+		e.mode = EditMode
+		reported := false
+		buf.onProgress = func(read, total int64) {
+			reported = true
+			e.showLoadProgress(fullPath, read, total)
+		}
 		state := buf.New(fullPath, e.log)
+		buf.onProgress = nil
+		if reported && !tm.IsInit {
+			// Clear the progress line left on terminal
+			fmt.Fprint(os.Stderr, "\r\x1b[K")
+		}
+		e.applySetting(buf, state == NotFound || fullPath == "")
 		if state != Success {
 			e.log.Warnf(fmt.Sprintf("buffer %d: fail to open file, %s with state %d", e.bufIdx, e.getBuf().filePath, state))
 		}
-		if state == IsDir {
+		if buf.canSwap() && buf.hasLeftoverSwap() {
+			buf.pendingSwap = true
+		}
+		switch state {
+		case IsDir:
 			e.mode = DirMode
-		} else {
-			e.mode = EditMode
+		case HasError:
+			e.setMsg(fmt.Sprintf("buffer %d: unable to open %s, see log for details", e.bufIdx, fullPath))
+			return
+		case ReadError:
+			e.setMsg(fmt.Sprintf("buffer %d: failed to read all of %s, buffer is read only", e.bufIdx, fullPath))
+			return
+		case NotFound:
+			e.setMsg(fmt.Sprintf("buffer %d: new file %s", e.bufIdx, fullPath))
+			return
+		}
+		if buf.isHex {
+			e.mode = HexMode
+			e.setMsg(fmt.Sprintf("buffer %d: opened binary file %s in hex mode", e.bufIdx, fullPath))
+			return
 		}
 	}
 	e.setMsg(fmt.Sprintf("buffer %d: opened %s", e.bufIdx, e.getBuf().filePath))
 }
 
-// Save current buffer to the given filepath
+// Apply editing options to an opened buffer, a new file also takes the
+// default encoding and line ending
+func (e *Editor) applySetting(buf *Buffer, isNew bool) {
+	buf.expandTabs = e.sett.ExpandTabs
+	buf.autoIndent = e.sett.AutoIndent
+	if isNew {
+		buf.encoding = e.sett.Encoding
+		buf.crlf = e.sett.LineEnding == "crlf"
+	}
+}
+
+// Show loading progress of a large file, on stderr for files given on command
+// line as they are loaded before the screen starts
+func (e *Editor) showLoadProgress(path string, read, total int64) {
+	msg := fmt.Sprintf("Loading %s ... %d%%", path, read*100/total)
+	if !tm.IsInit {
+		fmt.Fprintf(os.Stderr, "\r%s\x1b[K", msg)
+		return
+	}
+	e.setMsg(msg)
+	e.renderAll()
+}
+
+// Open each file in its own buffer and show the first one
+// Cursor is put on the line and column given with the file
+func (e *Editor) openFiles(files []FileArg) {
+	if len(files) == 0 {
+		files = []FileArg{{}}
+	}
+	for _, f := range files {
+		e.Open(f.Path, -1)
+		if f.Line > 0 {
+			*e.getBuf().cursor = e.getBuf().clampPos(Pos{f.Line - 1, f.Col - 1})
+		}
+	}
+	e.bufIdx = 0
+	e.mode = EditMode
+	e.identifyFileMode()
+	if len(e.bufs) > 1 {
+		e.setMsg(fmt.Sprintf("%d buffers opened", len(e.bufs)))
+	}
+}
+
+// Open content piped to stdin in a buffer, stdin can only be read once
+func (e *Editor) openStdin() {
+	if idx := e.hasFileOpened(STDIN_BUFFERNAME); idx >= 0 {
+		e.bufIdx = idx
+		return
+	}
+	buf := &Buffer{}
+	e.bufs = append(e.bufs, buf)
+	e.bufIdx = len(e.bufs) - 1
+	e.mode = EditMode
+	e.applySetting(buf, false)
+	if stat, err := os.Stdin.Stat(); err == nil && stat.Mode()&os.ModeCharDevice != 0 {
+		buf.NewFromReader(STDIN_BUFFERNAME, strings.NewReader(""), e.log)
+		e.setMsg("Nothing to read, stdin is a terminal")
+		return
+	}
+	if state := buf.NewFromReader(STDIN_BUFFERNAME, os.Stdin, e.log); state != Success {
+		e.setMsg("Failed to read all of stdin, buffer is read only")
+		return
+	}
+	e.setMsg(fmt.Sprintf("buffer %d: read %d lines from stdin", e.bufIdx, len(buf.lines)))
+}
+
+// Save the current buffer, overwriting a file changed on disk since it was
+// loaded needs confirmation
 func (e *Editor) Save(path string) {
+	e.mode = EditMode
 	fullPath, err := expandHomeDir(path)
 	if err != nil {
-		log.Errorf("unable to save file %s: %v", path, err)
+		e.log.Errorf("unable to save file %s: %v", path, err)
 		e.setMsg(fmt.Sprintf("Unable to save file: %s", err))
+		return
+	}
+	buf := e.getBuf()
+	if fullPath == buf.filePath {
+		buf.checkDisk()
+		buf.askReload = false
+		if buf.diskChanged {
+			e.savePath = fullPath
+			e.mode = ConfirmOverwriteOp
+			e.setMsg(fmt.Sprintf("%s changed on disk since loaded, overwrite it? (y/n)", getFilename(fullPath)))
+			return
+		}
 	}
-	wbyte, err := e.bufs[e.bufIdx].Save(fullPath)
+	e.saveFile(fullPath)
+}
+
+func (e *Editor) saveFile(fullPath string) {
+	e.mode = EditMode
+	wbyte, err := e.getBuf().Save(fullPath, e.sett.Backup)
 	if err != nil {
-		log.Errorf("Unable to save file %s: %v", path, err)
+		e.log.Errorf("Unable to save file %s: %v", fullPath, err)
 		e.setMsg(fmt.Sprintf("Unable to save file: %s", err))
+		return
 	}
-	e.mode = EditMode
 	e.setMsg(fmt.Sprintf("File saved %d byte written", wbyte))
 }
 
@@ -428,6 +1474,7 @@ func (e *Editor) Close() {
 		e.mode = ConfirmCloseOp
 		return
 	}
+	e.getBuf().removeSwap()
 	e.bufs = append(e.bufs[:idx], e.bufs[idx+1:]...)
 	e.nextBuffer()
 }
@@ -454,19 +1501,61 @@ func (e *Editor) toOpenFileMode() {
 	e.miscBuf.InsertString(e.getBuf().filePath)
 	e.render.miscBufRender.Reset()
 	e.mode = FileOpenMode
+	e.promptHist.Reset(e.mode)
 }
 
 func (e *Editor) toSaveFileMode() {
+	if e.getBuf().readOnly {
+		e.setMsg("Buffer is read only")
+		return
+	}
 	e.miscBuf.New("", e.log)
-	e.miscBuf.InsertString(e.getBuf().filePath)
+	if !e.getBuf().noFile {
+		e.miscBuf.InsertString(e.getBuf().filePath)
+	}
 	e.render.miscBufRender.Reset()
 	e.mode = FileSaveMode
+	e.promptHist.Reset(e.mode)
 }
 
 func (e *Editor) toSearchMode() {
 	e.miscBuf.New("", e.log)
 	e.render.miscBufRender.Reset()
+	e.search.Search("", e.getBuf())
+	e.search.startPos = *e.getBuf().cursor
 	e.mode = SearchMode
+	e.promptHist.Reset(e.mode)
+}
+
+func (e *Editor) toGoToLineMode() {
+	e.miscBuf.New("", e.log)
+	e.render.miscBufRender.Reset()
+	e.mode = GoToLineMode
+	e.promptHist.Reset(e.mode)
+}
+
+func (e *Editor) toEncodingMode(save bool) {
+	e.saveEncoding = save
+	e.miscBuf.New("", e.log)
+	e.miscBuf.InsertString(e.getBuf().getEncoding())
+	e.render.miscBufRender.Reset()
+	e.mode = EncodingMode
+	e.promptHist.Reset(e.mode)
+}
+
+func (e *Editor) toReplaceMode(all bool) {
+	e.miscBuf.New("", e.log)
+	e.render.miscBufRender.Reset()
+	e.replace.all = all
+	e.mode = ReplaceMode
+	e.promptHist.Reset(e.mode)
+}
+
+func (e *Editor) toGrepMode() {
+	e.miscBuf.New("", e.log)
+	e.render.miscBufRender.Reset()
+	e.mode = GrepMode
+	e.promptHist.Reset(e.mode)
 }
 
 func (e *Editor) toHelpPage() {
@@ -493,6 +1582,9 @@ func (e *Editor) nextBuffer() {
 	} else {
 		e.bufIdx = 0
 	}
+	if len(e.bufs) > 0 {
+		e.getBuf().checkDisk()
+	}
 	e.setMsg(fmt.Sprintf("Switch to buffer %d", e.bufIdx))
 }
 
@@ -502,6 +1594,9 @@ func (e *Editor) prevBuffer() {
 	} else {
 		e.bufIdx = len(e.bufs) - 1
 	}
+	if len(e.bufs) > 0 {
+		e.getBuf().checkDisk()
+	}
 	e.setMsg(fmt.Sprintf("Switch to buffer %d", e.bufIdx))
 }
 
@@ -521,16 +1616,31 @@ func (e *Editor) getHelpDoc() {
 }
 
 func (e *Editor) getRenderContent() RenderContent {
+	commands, selected := e.getCommandCandidates()
 	return RenderContent{
-		buf:      e.getBuf(),
-		miscBuf:  e.miscBuf,
-		mode:     e.mode,
-		mod:      e.key.mod,
-		key:      e.key.key,
-		ch:       e.key.ch,
-		bufIdx:   e.bufIdx,
-		bufDirty: e.getBuf().dirty,
+		buf:       e.getBuf(),
+		miscBuf:   e.miscBuf,
+		mode:      e.mode,
+		mod:       e.key.mod,
+		key:       e.key.key,
+		ch:        e.key.ch,
+		bufIdx:    e.bufIdx,
+		bufDirty:  e.getBuf().dirty,
+		search:    e.getSearchStatus(),
+		chord:     e.key.Pending(),
+		recording: e.macro.recording,
+		commands:  commands,
+		selected:  selected,
+		prompt:    e.getCommandPrompt(),
+		flags:     e.search.Flags(),
+	}
+}
+
+func (e *Editor) getSearchStatus() string {
+	if e.mode != SearchMode || e.getPromptInput() == "" {
+		return ""
 	}
+	return e.search.Status()
 }
 
 func (e *Editor) renderAll() {
@@ -0,0 +1,335 @@
+package pine
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+/*
+ * Encoding
+ *
+ * Files are decoded to runes on load and encoded back on save. A byte which
+ * is not valid in the file encoding is kept as an escape rune in the private
+ * use area, U+10FF00 plus the byte, and written back as the same byte.
+ * Runes in that range are only taken as escapes in a buffer whose content
+ * had invalid bytes, in other buffers they are real characters.
+ * Swap files are always written in UTF-8 with the same escapes.
+ */
+
+const (
+	UTF8Encoding     = "utf-8"
+	UTF16LEEncoding  = "utf-16le"
+	UTF16BEEncoding  = "utf-16be"
+	Latin1Encoding   = "latin-1"
+	GBKEncoding      = "gbk"
+	ShiftJISEncoding = "shift-jis"
+)
+
+var supportedEncodings = []string{
+	UTF8Encoding, UTF16LEEncoding, UTF16BEEncoding, Latin1Encoding, GBKEncoding, ShiftJISEncoding,
+}
+
+const escapeRuneBase = 0x10FF00
+
+func escapeByte(b byte) rune {
+	return rune(escapeRuneBase + int(b))
+}
+
+func isEscapeRune(r rune) bool {
+	return r >= escapeRuneBase && r <= escapeRuneBase+0xFF
+}
+
+func isSupportedEncoding(name string) bool {
+	for _, enc := range supportedEncodings {
+		if enc == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Buffer) getEncoding() string {
+	if b.encoding == "" {
+		return UTF8Encoding
+	}
+	return b.encoding
+}
+
+// Load content in the buffer encoding, the encoding is detected from the
+// beginning of content if the buffer has none
+func (b *Buffer) loadContent(r io.Reader, size int64) error {
+	reader := bufio.NewReaderSize(r, READ_BUFFER_SIZE)
+	if b.encoding == "" {
+		sample, _ := reader.Peek(ENCODING_SNIFF_LEN)
+		if !hasUTF16BOM(sample) && isBinary(sample) {
+			data, err := io.ReadAll(reader)
+			b.openHex(data)
+			return err
+		}
+		b.encoding = detectEncoding(sample, len(sample) < ENCODING_SNIFF_LEN)
+	}
+	if b.encoding == UTF8Encoding {
+		return b.readLines(reader, size)
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	txt, escaped := decodeText(data, b.encoding)
+	b.escaped = escaped
+	return b.readLines(strings.NewReader(txt), 0)
+}
+
+// Detect encoding from BOM, otherwise content which is mostly valid UTF-8 is
+// UTF-8, Shift-JIS needs kana and GBK needs common Chinese characters, and
+// latin-1 takes anything else
+// complete tells if sample is the whole content
+func detectEncoding(sample []byte, complete bool) string {
+	if hasUTF16BOM(sample) {
+		if sample[0] == 0xFF {
+			return UTF16LEEncoding
+		}
+		return UTF16BEEncoding
+	}
+	// A character can be cut at the end of the sample
+	if i := bytes.LastIndexByte(sample, '\n'); !complete && i >= 0 {
+		sample = sample[:i+1]
+	}
+	valid, invalid := 0, 0
+	for i := 0; i < len(sample); {
+		r, size := utf8.DecodeRune(sample[i:])
+		if r == utf8.RuneError && size == 1 {
+			invalid++
+		} else if size > 1 {
+			valid++
+		}
+		i += size
+	}
+	if invalid == 0 || valid >= invalid {
+		return UTF8Encoding
+	}
+	if txt, invalid := decodeLegacy(sample, ShiftJISEncoding); invalid == 0 && hasKana(txt) {
+		return ShiftJISEncoding
+	}
+	if _, invalid := decodeLegacy(sample, GBKEncoding); invalid == 0 && isLikelyGBK(sample) {
+		return GBKEncoding
+	}
+	return Latin1Encoding
+}
+
+// Check if most double byte characters of GBK content are in the GB2312
+// range, where common Chinese characters and punctuation are. Latin-1 text
+// also decodes as GBK but its pairs are mostly an accented letter followed by
+// an ASCII one, which is outside the range
+func isLikelyGBK(data []byte) bool {
+	pairs, common := 0, 0
+	for i := 0; i < len(data); {
+		if getLegacyCharLen(data[i], GBKEncoding) != 2 || i+1 >= len(data) {
+			i++
+			continue
+		}
+		pairs++
+		if data[i] >= 0xA1 && data[i] <= 0xF7 && data[i+1] >= 0xA1 && data[i+1] <= 0xFE {
+			common++
+		}
+		i += 2
+	}
+	return common >= GBK_MIN_PAIRS && common*2 > pairs
+}
+
+func hasUTF16BOM(data []byte) bool {
+	return bytes.HasPrefix(data, []byte{0xFF, 0xFE}) || bytes.HasPrefix(data, []byte{0xFE, 0xFF})
+}
+
+func hasKana(txt string) bool {
+	for _, r := range txt {
+		if r >= 0x3040 && r <= 0x30FF {
+			return true
+		}
+	}
+	return false
+}
+
+// Decode content to a UTF-8 string with escape runes for invalid bytes,
+// escaped tells if there was any
+func decodeText(data []byte, name string) (string, bool) {
+	switch name {
+	case UTF16LEEncoding, UTF16BEEncoding:
+		return decodeUTF16(data, name == UTF16BEEncoding)
+	case Latin1Encoding:
+		runes := make([]rune, len(data))
+		for i, c := range data {
+			runes[i] = rune(c)
+		}
+		return string(runes), false
+	case GBKEncoding, ShiftJISEncoding:
+		txt, invalid := decodeLegacy(data, name)
+		return txt, invalid > 0
+	}
+	runes, escaped := decodeUTF8(string(data))
+	return string(runes), escaped
+}
+
+// Convert a UTF-8 string to runes, invalid bytes become escape runes and
+// escaped tells if there was any
+func decodeUTF8(txt string) ([]rune, bool) {
+	if utf8.ValidString(txt) {
+		return []rune(txt), false
+	}
+	runes := make([]rune, 0, len(txt))
+	for i := 0; i < len(txt); {
+		r, size := utf8.DecodeRuneInString(txt[i:])
+		if r == utf8.RuneError && size == 1 {
+			r = escapeByte(txt[i])
+		}
+		runes = append(runes, r)
+		i += size
+	}
+	return runes, true
+}
+
+func decodeUTF16(data []byte, bigEndian bool) (string, bool) {
+	var sb strings.Builder
+	escaped := false
+	unit := func(i int) uint16 {
+		if bigEndian {
+			return uint16(data[i])<<8 | uint16(data[i+1])
+		}
+		return uint16(data[i+1])<<8 | uint16(data[i])
+	}
+	i := 0
+	for ; i+1 < len(data); i += 2 {
+		u := unit(i)
+		if !utf16.IsSurrogate(rune(u)) {
+			sb.WriteRune(rune(u))
+			continue
+		}
+		if i+3 < len(data) {
+			if r := utf16.DecodeRune(rune(u), rune(unit(i+2))); r != utf8.RuneError {
+				sb.WriteRune(r)
+				i += 2
+				continue
+			}
+		}
+		// Unpaired surrogate is kept as raw bytes
+		sb.WriteRune(escapeByte(data[i]))
+		sb.WriteRune(escapeByte(data[i+1]))
+		escaped = true
+	}
+	if i < len(data) {
+		sb.WriteRune(escapeByte(data[i]))
+		escaped = true
+	}
+	return sb.String(), escaped
+}
+
+// Decode GBK or Shift-JIS by character and return the number of invalid bytes
+func decodeLegacy(data []byte, name string) (string, int) {
+	decoder := getLegacyEncoding(name).NewDecoder()
+	var sb strings.Builder
+	invalid := 0
+	for i := 0; i < len(data); {
+		n := getLegacyCharLen(data[i], name)
+		if n == 1 && data[i] < 0x80 {
+			sb.WriteByte(data[i])
+			i++
+			continue
+		}
+		if n > 0 && i+n <= len(data) {
+			if ch, err := decoder.Bytes(data[i : i+n]); err == nil && !bytes.Contains(ch, []byte("\uFFFD")) {
+				sb.Write(ch)
+				i += n
+				continue
+			}
+		}
+		sb.WriteRune(escapeByte(data[i]))
+		invalid++
+		i++
+	}
+	return sb.String(), invalid
+}
+
+// Return byte length of the character led by c, 0 if c cannot lead a character
+func getLegacyCharLen(c byte, name string) int {
+	if c < 0x80 {
+		return 1
+	}
+	if name == ShiftJISEncoding {
+		switch {
+		case c >= 0xA1 && c <= 0xDF:
+			return 1
+		case (c >= 0x81 && c <= 0x9F) || (c >= 0xE0 && c <= 0xFC):
+			return 2
+		}
+		return 0
+	}
+	if c >= 0x81 && c <= 0xFE {
+		return 2
+	}
+	return 0
+}
+
+func getLegacyEncoding(name string) encoding.Encoding {
+	if name == ShiftJISEncoding {
+		return japanese.ShiftJIS
+	}
+	return simplifiedchinese.GBK
+}
+
+// Encode a UTF-8 string in the named encoding, escape runes are written as
+// their raw bytes if escaped is set, a rune the encoding cannot represent is
+// an error
+func encodeText(txt string, name string, escaped bool) ([]byte, error) {
+	// Escape runes are encoded in UTF-8 with a leading 0xF4 byte
+	if name == UTF8Encoding && (!escaped || strings.IndexByte(txt, 0xF4) < 0) {
+		return []byte(txt), nil
+	}
+	out := make([]byte, 0, len(txt))
+	var encoder *encoding.Encoder
+	if name == GBKEncoding || name == ShiftJISEncoding {
+		encoder = getLegacyEncoding(name).NewEncoder()
+	}
+	for _, r := range txt {
+		if escaped && isEscapeRune(r) {
+			out = append(out, byte(r-escapeRuneBase))
+			continue
+		}
+		switch name {
+		case UTF16LEEncoding, UTF16BEEncoding:
+			for _, u := range utf16.Encode([]rune{r}) {
+				if name == UTF16BEEncoding {
+					out = append(out, byte(u>>8), byte(u))
+				} else {
+					out = append(out, byte(u), byte(u>>8))
+				}
+			}
+		case Latin1Encoding:
+			if r > 0xFF {
+				return nil, fmt.Errorf("%q cannot be encoded in %s", r, name)
+			}
+			out = append(out, byte(r))
+		case GBKEncoding, ShiftJISEncoding:
+			if r < 0x80 {
+				out = append(out, byte(r))
+				continue
+			}
+			ch, err := encoder.String(string(r))
+			if err != nil {
+				return nil, fmt.Errorf("%q cannot be encoded in %s", r, name)
+			}
+			out = append(out, ch...)
+		default:
+			out = utf8.AppendRune(out, r)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,117 @@
+package pine
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+/*
+ * File format
+ *
+ * Line content in buffer never holds line endings. The line ending style,
+ * whether the last line ends with a newline and the UTF-8 BOM are detected
+ * on load and written back on save, so that a file round-trips unchanged.
+ * The line ending of the first line decides the style of the whole file.
+ */
+
+const utf8BOM = "\uFEFF"
+
+// Strip BOM and line ending of a raw line and record the file format
+func (b *Buffer) parseRawLine(txt string, first bool) string {
+	if first && strings.HasPrefix(txt, utf8BOM) {
+		b.bom = true
+		txt = strings.TrimPrefix(txt, utf8BOM)
+	}
+	if !strings.HasSuffix(txt, "\n") {
+		b.noEOL = true
+		return txt
+	}
+	b.noEOL = false
+	txt = strings.TrimSuffix(txt, "\n")
+	if first && strings.HasSuffix(txt, "\r") {
+		b.crlf = true
+	}
+	if b.crlf {
+		txt = strings.TrimSuffix(txt, "\r")
+	}
+	return txt
+}
+
+// Write buffer content in its file format and return bytes written
+func (b *Buffer) writeLines(w io.Writer) (int, error) {
+	return b.writeLinesAs(w, b.getEncoding())
+}
+
+// Hex mode content is written as raw bytes
+func (b *Buffer) writeLinesAs(w io.Writer, encoding string) (int, error) {
+	if b.isHex {
+		return w.Write(b.data)
+	}
+	writer := bufio.NewWriter(w)
+	totalbyte := 0
+	write := func(txt string) error {
+		data, err := encodeText(txt, encoding, b.escaped)
+		if err != nil {
+			return err
+		}
+		wbyte, err := writer.Write(data)
+		totalbyte += wbyte
+		return err
+	}
+	if b.bom {
+		if err := write(utf8BOM); err != nil {
+			return 0, err
+		}
+	}
+	eol := b.getLineEnding()
+	for i, l := range b.lines {
+		txt := string(l.txt)
+		if i < len(b.lines)-1 || !b.noEOL {
+			txt += eol
+		}
+		if err := write(txt); err != nil {
+			return 0, err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return 0, err
+	}
+	return totalbyte, nil
+}
+
+func (b *Buffer) getLineEnding() string {
+	if b.crlf {
+		return "\r\n"
+	}
+	return "\n"
+}
+
+func (b *Buffer) getLineEndingName() string {
+	if b.crlf {
+		return "CRLF"
+	}
+	return "LF"
+}
+
+// Convert line endings between LF and CRLF, the change is saved with the buffer
+func (b *Buffer) ToggleLineEnding() {
+	b.crlf = !b.crlf
+	b.history.markUnsaved()
+	b.setDirty()
+}
+
+// Return file format shown in status line, e.g. "utf-8 LF", "gbk CRLF noeol"
+func (b *Buffer) getFormat() string {
+	if b.isHex {
+		return "hex"
+	}
+	format := b.getEncoding() + " " + b.getLineEndingName()
+	if b.bom {
+		format += " BOM"
+	}
+	if b.noEOL {
+		format += " noeol"
+	}
+	return format
+}
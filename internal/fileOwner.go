@@ -0,0 +1,16 @@
+//go:build !windows
+
+package pine
+
+import (
+	"os"
+	"syscall"
+)
+
+// Give the file the owner and group of the original file
+// It only works for root or the owner, otherwise the file keeps the current user
+func copyFileOwner(orig os.FileInfo, path string) {
+	if stat, ok := orig.Sys().(*syscall.Stat_t); ok {
+		os.Lchown(path, int(stat.Uid), int(stat.Gid))
+	}
+}
@@ -0,0 +1,8 @@
+//go:build windows
+
+package pine
+
+import "os"
+
+// Windows files have no unix owner to keep
+func copyFileOwner(orig os.FileInfo, path string) {}
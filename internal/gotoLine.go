@@ -0,0 +1,47 @@
+package pine
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Parse go to line input into a buffer position
+// Input is 1 based "line" or "line:col", "+N"/"-N" lines from the cursor or "N%"
+// of the buffer, the result is clamped to buffer content
+func parseGoToLine(input string, buf *Buffer) (Pos, error) {
+	input = strings.TrimSpace(input)
+	if input == "" {
+		return Pos{}, fmt.Errorf("empty line number")
+	}
+	p := Pos{buf.cursor.x, 0}
+	switch {
+	case strings.HasSuffix(input, "%"):
+		per, err := strconv.Atoi(strings.TrimSuffix(input, "%"))
+		if err != nil {
+			return Pos{}, fmt.Errorf("invalid percentage %s", input)
+		}
+		p.x = per * (len(buf.lines) - 1) / 100
+	case input[0] == '+' || input[0] == '-':
+		n, err := strconv.Atoi(input)
+		if err != nil {
+			return Pos{}, fmt.Errorf("invalid line offset %s", input)
+		}
+		p.x += n
+	default:
+		lineStr, colStr, hasCol := strings.Cut(input, ":")
+		x, err := strconv.Atoi(lineStr)
+		if err != nil {
+			return Pos{}, fmt.Errorf("invalid line number %s", lineStr)
+		}
+		p.x = x - 1
+		if hasCol {
+			y, err := strconv.Atoi(colStr)
+			if err != nil {
+				return Pos{}, fmt.Errorf("invalid column number %s", colStr)
+			}
+			p.y = y - 1
+		}
+	}
+	return buf.clampPos(p), nil
+}
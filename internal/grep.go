@@ -0,0 +1,144 @@
+package pine
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	tm "github.com/nsf/termbox-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// Result lines are "path:line:col: text", path is relative to the grep root
+var grepResultPattern = regexp.MustCompile(`^(.+?):(\d+):(\d+): `)
+
+// Grep searches files under root in background and sends matched lines in batches
+// buf is the result buffer which batches are appended to by the editor loop
+type Grep struct {
+	root    string
+	buf     *Buffer
+	batches chan grepBatch
+	cancel  context.CancelFunc
+	count   int
+	files   int
+	log     *log.Logger
+}
+
+type grepBatch struct {
+	lines []string
+	files int
+	done  bool
+}
+
+// Start walking root in a goroutine, it wakes the editor loop up by interrupting
+// termbox event polling whenever a batch is ready
+func (g *Grep) Start(pattern *regexp.Regexp, search Search) {
+	ctx, cancel := context.WithCancel(context.Background())
+	g.cancel = cancel
+	g.batches = make(chan grepBatch, GREP_BATCH_QUEUE)
+	go g.walk(ctx, pattern, search)
+}
+
+func (g *Grep) Stop() {
+	if g.cancel != nil {
+		g.cancel()
+	}
+}
+
+func (g *Grep) walk(ctx context.Context, pattern *regexp.Regexp, search Search) {
+	batch := grepBatch{}
+	lastSent := time.Now()
+	send := func() bool {
+		select {
+		case g.batches <- batch:
+		case <-ctx.Done():
+			return false
+		}
+		tm.Interrupt()
+		batch = grepBatch{}
+		lastSent = time.Now()
+		return true
+	}
+	err := filepath.WalkDir(g.root, func(path string, d fs.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			g.log.Debugf("grep: skip %s: %v", path, err)
+			return nil
+		}
+		if d.IsDir() {
+			if d.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		lines := grepFile(path, g.root, pattern, search)
+		if len(lines) > 0 {
+			batch.lines = append(batch.lines, lines...)
+			batch.files++
+		}
+		if len(batch.lines) >= GREP_BATCH_SIZE || (len(batch.lines) > 0 && time.Since(lastSent) > 100*time.Millisecond) {
+			if !send() {
+				return ctx.Err()
+			}
+		}
+		return nil
+	})
+	if err != nil && ctx.Err() == nil {
+		g.log.Warnf("grep: failed to walk %s: %v", g.root, err)
+	}
+	batch.done = true
+	send()
+}
+
+// Return result lines of a file, binary files are skipped
+func grepFile(path, root string, pattern *regexp.Regexp, search Search) []string {
+	data, err := os.ReadFile(path)
+	if err != nil || isBinary(data) {
+		return nil
+	}
+	name, err := filepath.Rel(root, path)
+	if err != nil {
+		name = path
+	}
+	results := []string{}
+	content := strings.TrimSuffix(string(data), "\n")
+	for i, txt := range strings.Split(content, "\n") {
+		runes := []rune(strings.TrimSuffix(txt, "\r"))
+		for _, loc := range search.findInLine(pattern, runes) {
+			results = append(results, fmt.Sprintf("%s:%d:%d: %s", name, i+1, loc[0]+1, string(runes)))
+		}
+	}
+	return results
+}
+
+// Content with a NUL byte in the first block is treated as binary
+func isBinary(data []byte) bool {
+	if len(data) > BINARY_SNIFF_LEN {
+		data = data[:BINARY_SNIFF_LEN]
+	}
+	return bytes.IndexByte(data, 0) >= 0
+}
+
+// Parse a result line into file path, line and column
+// Line and column are converted to 0 based buffer position
+func parseGrepResult(root, txt string) (string, Pos, bool) {
+	m := grepResultPattern.FindStringSubmatch(txt)
+	if m == nil {
+		return "", Pos{}, false
+	}
+	x, _ := strconv.Atoi(m[2])
+	y, _ := strconv.Atoi(m[3])
+	return filepath.Join(root, m[1]), Pos{x - 1, y - 1}, true
+}
@@ -0,0 +1,122 @@
+package pine
+
+/*
+ * Hex mode
+ *
+ * Binary content is kept as raw bytes in data instead of lines. The cursor x
+ * is the byte offset and y is the nibble, 0 for the high and 1 for the low
+ * half of the byte. hexASCII moves the cursor to the ASCII column where a
+ * typed character overwrites the whole byte.
+ */
+
+// Open content as raw bytes in hex mode
+func (b *Buffer) openHex(data []byte) {
+	b.isHex = true
+	b.data = data
+	b.lines = []line{}
+}
+
+// Move hex cursor by the key operation, page is the number of rows of half a page
+func (b *Buffer) MoveHexCursor(op KeyOps, page int) {
+	if len(b.data) == 0 {
+		return
+	}
+	offset, nibble := b.cursor.x, b.cursor.y
+	switch op {
+	case MoveCursorLeftOp:
+		if !b.hexASCII && nibble == 1 {
+			nibble = 0
+		} else if offset > 0 {
+			offset--
+			nibble = 1
+		}
+	case MoveCursorRightOp:
+		if !b.hexASCII && nibble == 0 {
+			nibble = 1
+		} else if offset < len(b.data)-1 {
+			offset++
+			nibble = 0
+		}
+	case MoveCursorUpOp:
+		if offset >= HEX_ROW_LEN {
+			offset -= HEX_ROW_LEN
+		}
+	case MoveCursorDownOp:
+		if offset+HEX_ROW_LEN < len(b.data) {
+			offset += HEX_ROW_LEN
+		}
+	case PrevHalfPageOp:
+		offset -= page * HEX_ROW_LEN
+	case NextHalfPageOp:
+		offset += page * HEX_ROW_LEN
+	case GoToBOLOp:
+		offset -= offset % HEX_ROW_LEN
+		nibble = 0
+	case GoToEOLOp:
+		offset += HEX_ROW_LEN - 1 - offset%HEX_ROW_LEN
+		nibble = 1
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	if offset >= len(b.data) {
+		offset = len(b.data) - 1
+	}
+	if b.hexASCII {
+		nibble = 0
+	}
+	b.cursor.x, b.cursor.y = offset, nibble
+}
+
+// Switch the cursor between hex and ASCII columns
+func (b *Buffer) ToggleHexColumn() {
+	b.hexASCII = !b.hexASCII
+	b.cursor.y = 0
+}
+
+// Overwrite the nibble or byte under cursor and move to the next one
+// Returns false if ch is not a hex digit in hex column or not ASCII in ASCII column
+func (b *Buffer) HexOverwrite(ch rune) bool {
+	offset := b.cursor.x
+	if offset >= len(b.data) {
+		return false
+	}
+	old := b.data[offset]
+	var val byte
+	if b.hexASCII {
+		if ch < 0x20 || ch >= 0x7F {
+			return false
+		}
+		val = byte(ch)
+	} else {
+		v, ok := getHexValue(ch)
+		if !ok {
+			return false
+		}
+		if b.cursor.y == 0 {
+			val = v<<4 | old&0x0F
+		} else {
+			val = old&0xF0 | v
+		}
+	}
+	before := *b.cursor
+	ed := edit{kind: replaceByteEdit, pos: Pos{offset, 0}, txt: []rune{rune(old), rune(val)}}
+	b.applyEdit(ed)
+	b.MoveHexCursor(MoveCursorRightOp, 0)
+	b.lastModifiedCh = "hex"
+	b.commit([]edit{ed}, before, false)
+	b.setDirty()
+	return true
+}
+
+func getHexValue(ch rune) (byte, bool) {
+	switch {
+	case ch >= '0' && ch <= '9':
+		return byte(ch - '0'), true
+	case ch >= 'a' && ch <= 'f':
+		return byte(ch-'a') + 10, true
+	case ch >= 'A' && ch <= 'F':
+		return byte(ch-'A') + 10, true
+	}
+	return 0, false
+}
@@ -0,0 +1,166 @@
+package pine
+
+type editKind int64
+
+const (
+	insertTextEdit editKind = iota
+	deleteTextEdit
+	insertLineEdit
+	deleteLineEdit
+	replaceByteEdit
+)
+
+// edit is a single reversible change on buffer lines
+// For text edits, pos is where txt starts and txt may contain '\n'
+// For line edits, pos.x is the index of the inserted or removed line
+// For byte edits in hex mode, pos.x is the offset and txt is the old and new byte
+type edit struct {
+	kind editKind
+	pos  Pos
+	txt  []rune
+}
+
+func (ed edit) inverse() edit {
+	inv := ed
+	switch ed.kind {
+	case insertTextEdit:
+		inv.kind = deleteTextEdit
+	case deleteTextEdit:
+		inv.kind = insertTextEdit
+	case insertLineEdit:
+		inv.kind = deleteLineEdit
+	case deleteLineEdit:
+		inv.kind = insertLineEdit
+	case replaceByteEdit:
+		inv.txt = []rune{ed.txt[1], ed.txt[0]}
+	}
+	return inv
+}
+
+// editGroup is one undo step
+// cursorBefore and cursorAfter are restored on undo and redo respectively
+type editGroup struct {
+	edits        []edit
+	cursorBefore Pos
+	cursorAfter  Pos
+	mergeable    bool
+}
+
+// History keeps undo and redo stacks of a buffer
+// savedAt is the undo depth of the last saved state, -1 if it cannot be reached anymore
+type History struct {
+	undos   []*editGroup
+	redos   []*editGroup
+	savedAt int
+	pending *editGroup
+	depth   int
+}
+
+func (h *History) Reset() {
+	h.undos = []*editGroup{}
+	h.redos = []*editGroup{}
+	h.savedAt = 0
+	h.pending = nil
+	h.depth = 0
+}
+
+// Record edits made by one buffer operation
+// Mergeable edits are folded into the previous step if it is mergeable too and
+// the cursor has not moved in between, so that typing a word is undone at once
+func (h *History) record(edits []edit, before, after Pos, mergeable bool) {
+	if len(edits) == 0 {
+		return
+	}
+	if h.depth > 0 {
+		h.pending.edits = append(h.pending.edits, edits...)
+		h.pending.cursorAfter = after
+		return
+	}
+	top := h.top()
+	if mergeable && top != nil && top.mergeable && top.cursorAfter == before &&
+		len(h.redos) == 0 && h.savedAt != len(h.undos) {
+		top.edits = append(top.edits, edits...)
+		top.cursorAfter = after
+		return
+	}
+	h.push(&editGroup{
+		edits:        edits,
+		cursorBefore: before,
+		cursorAfter:  after,
+		mergeable:    mergeable,
+	})
+}
+
+func (h *History) push(group *editGroup) {
+	if h.savedAt > len(h.undos) {
+		h.savedAt = -1
+	}
+	h.undos = append(h.undos, group)
+	h.redos = []*editGroup{}
+}
+
+// Start grouping every following edit into a single undo step until end is called
+// Calls can be nested, only the outermost pair creates the step
+func (h *History) begin(cursor Pos) {
+	if h.depth == 0 {
+		h.pending = &editGroup{cursorBefore: cursor, cursorAfter: cursor}
+	}
+	h.depth++
+}
+
+func (h *History) end(cursor Pos) {
+	if h.depth == 0 {
+		return
+	}
+	h.depth--
+	if h.depth > 0 {
+		return
+	}
+	group := h.pending
+	h.pending = nil
+	if len(group.edits) == 0 {
+		return
+	}
+	group.cursorAfter = cursor
+	h.push(group)
+}
+
+func (h *History) top() *editGroup {
+	if len(h.undos) == 0 {
+		return nil
+	}
+	return h.undos[len(h.undos)-1]
+}
+
+func (h *History) popUndo() *editGroup {
+	group := h.top()
+	if group == nil {
+		return nil
+	}
+	h.undos = h.undos[:len(h.undos)-1]
+	h.redos = append(h.redos, group)
+	return group
+}
+
+func (h *History) popRedo() *editGroup {
+	if len(h.redos) == 0 {
+		return nil
+	}
+	group := h.redos[len(h.redos)-1]
+	h.redos = h.redos[:len(h.redos)-1]
+	h.undos = append(h.undos, group)
+	return group
+}
+
+func (h *History) markSaved() {
+	h.savedAt = len(h.undos)
+}
+
+// Saved state cannot be reached by undo or redo after a change outside history
+func (h *History) markUnsaved() {
+	h.savedAt = -1
+}
+
+func (h *History) isSaved() bool {
+	return h.savedAt == len(h.undos)
+}
@@ -1,6 +1,10 @@
 package pine
 
 import (
+	"fmt"
+	"strconv"
+	"strings"
+
 	log "github.com/sirupsen/logrus"
 
 	"github.com/mattn/go-runewidth"
@@ -8,96 +12,142 @@ import (
 )
 
 type KeyMapper struct {
-	op  KeyOps
-	mod tm.Modifier
-	ch  rune
-	key tm.Key
+	op     KeyOps
+	prevOp KeyOps
+	mod    tm.Modifier
+	ch     rune
+	key    tm.Key
+	keymap *Keymap
+	// Keys typed so far of an unfinished key sequence
+	chord string
+	// Numeric prefix given with C-u or Alt-digits, count is the prefix taken
+	// by the current op, 1 if none, argClamped tells if arg was larger than
+	// MAX_PREFIX_ARG
+	count      int
+	hasArg     bool
+	arg        int
+	argDigits  string
+	argClamped bool
 }
 
-func (k *KeyMapper) Map(event tm.Event) {
-	isCmd := false
-	if k.op == CmdOp {
-		isCmd = true
-	}
-	k.op = mapKey(event, isCmd)
+func NewKeyMapper() *KeyMapper {
+	return &KeyMapper{keymap: newKeymap()}
+}
+
+func (k *KeyMapper) Map(event tm.Event, mode Mode) {
+	k.prevOp = k.op
+	k.op = k.mapKey(event, mode)
 	k.mod = event.Mod
 	k.key = event.Key
 	if k.op != NoOp {
 		k.ch = event.Ch
 	}
+	k.mapArg(event)
+}
+
+// Drop an unfinished key sequence and numeric prefix
+func (k *KeyMapper) ClearPending() {
+	k.chord = ""
+	k.hasArg = false
+}
+
+// Collect the numeric prefix, C-u alone is 4 and each further C-u multiplies
+// it by 4, digits typed after C-u or Alt-digits give the number, which is
+// limited to MAX_PREFIX_ARG
+func (k *KeyMapper) mapArg(event tm.Event) {
+	isDigit := event.Ch >= '0' && event.Ch <= '9'
+	switch {
+	case k.op == UniversalArgOp:
+		if !k.hasArg {
+			k.hasArg, k.arg, k.argDigits, k.argClamped = true, 4, "", false
+		} else if k.argDigits == "" {
+			k.setArg(k.arg*4, k.arg > MAX_PREFIX_ARG/4)
+		}
+	case k.op == DigitArgOp && isDigit, k.hasArg && k.op == InsertChOp && isDigit:
+		k.op = DigitArgOp
+		if !k.hasArg {
+			k.hasArg, k.argDigits, k.argClamped = true, "", false
+		}
+		if !k.argClamped {
+			k.argDigits += string(event.Ch)
+			n, err := strconv.Atoi(k.argDigits)
+			k.setArg(n, err != nil)
+		}
+	case k.op == CmdOp:
+		// Prefix is kept for the op at the end of the key sequence
+	default:
+		k.count = 1
+		if k.hasArg {
+			k.count = k.arg
+		}
+		k.hasArg = false
+	}
+}
+
+func (k *KeyMapper) setArg(n int, overflow bool) {
+	if overflow || n > MAX_PREFIX_ARG {
+		n = MAX_PREFIX_ARG
+		k.argClamped = true
+	}
+	k.arg = n
 }
 
-func mapKey(event tm.Event, isCmd bool) KeyOps {
+// Return the numeric prefix and unfinished key sequence as shown in status
+// line, e.g. "C-u 8 C-x-"
+func (k *KeyMapper) Pending() string {
+	pending := []string{}
+	if k.hasArg {
+		pending = append(pending, fmt.Sprintf("C-u %d", k.arg))
+		if k.argClamped {
+			pending = append(pending, "(max)")
+		}
+	}
+	if k.chord != "" {
+		pending = append(pending, k.chord)
+	}
+	if len(pending) == 0 {
+		return ""
+	}
+	return strings.Join(pending, " ") + "-"
+}
+
+// Check if an op can be repeated by a numeric prefix, ops which close or
+// leave the buffer or handle the prefix themselves cannot
+func isRepeatable(op KeyOps) bool {
+	switch op {
+	case ExitOp, CloseFileOp, HelpOp, OpenFileOp, SaveFileOp, NextBufferOp, PrevBufferOp,
+		StartMacroOp, StopMacroOp, RunMacroOp, CommandOp, CmdOp:
+		return false
+	}
+	return true
+}
+
+// Map a key to the operation bound to the key sequence it ends, a key which
+// starts or continues a longer sequence maps to CmdOp
+func (k *KeyMapper) mapKey(event tm.Event, mode Mode) KeyOps {
 	if event.Type != tm.EventKey && event.Type != tm.EventMouse {
 		log.Warnf("detected non key/mouse interaction")
 		return NoOp
 	}
-	if isCmd {
-		switch event.Key {
-		case tm.KeyCtrlX:
-			return ExitOp
-		case tm.KeyCtrlG:
-			return CancelOp
-		}
-		switch event.Ch {
-		case rune('k'):
-			return CloseFileOp
-		}
+	chord := k.chord
+	k.chord = ""
+	name := getKeyName(event)
+	if event.Type != tm.EventKey || name == "" {
 		return NoOp
 	}
-	if event.Mod == tm.ModAlt {
-		switch event.Ch {
-		case rune(','):
-			return PrevBufferOp
-		case rune('.'):
-			return NextBufferOp
-		}
+	seq := name
+	if chord != "" {
+		seq = chord + " " + name
 	}
-	switch event.Key {
-	case tm.KeyCtrlX:
+	if op, ok := k.keymap.lookup(mode, seq); ok {
+		return op
+	}
+	if k.keymap.isPrefix(mode, seq) {
+		k.chord = seq
 		return CmdOp
-	case tm.KeyCtrlG:
-		return CancelOp
-	case tm.KeyCtrlR:
-		return OpenFileOp
-	case tm.KeyCtrlO:
-		return SaveFileOp
-	case tm.KeyCtrlS:
-		return SearchOp
-	case tm.KeyCtrlSlash:
-		return HelpOp
-	case tm.KeyCtrlA:
-		return GoToBOLOp
-	case tm.KeyCtrlE:
-		return GoToEOLOp
-	case tm.KeyCtrlV, tm.KeyPgdn:
-		return NextHalfPageOp
-	case tm.KeyCtrlZ, tm.KeyPgup:
-		return PrevHalfPageOp
-	case tm.KeyCtrlK:
-		return DeleteLineOp
-	case tm.KeyArrowUp, tm.KeyCtrlP:
-		return MoveCursorUpOp
-	case tm.KeyArrowDown, tm.KeyCtrlN:
-		return MoveCursorDownOp
-	case tm.KeyArrowLeft:
-		return MoveCursorLeftOp
-	case tm.KeyArrowRight:
-		return MoveCursorRightOp
-	case tm.KeyEnter:
-		return InsertEnterOp
-	case tm.KeyBackspace, tm.KeyBackspace2:
-		return DeleteChOp
-	case tm.KeySpace:
-		return InsertSpaceOp
-	case tm.KeyTab:
-		return InsertTabOp
-	case tm.KeyCtrlB:
-		return NextBufferOp
-	default:
-		if runewidth.RuneWidth(event.Ch) > 0 {
-			return InsertChOp
-		}
+	}
+	if chord == "" && event.Mod == 0 && runewidth.RuneWidth(event.Ch) > 0 {
+		return InsertChOp
 	}
 	return NoOp
 }
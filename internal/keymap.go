@@ -0,0 +1,396 @@
+package pine
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	tm "github.com/nsf/termbox-go"
+)
+
+/*
+ * Keymap
+ *
+ * A binding maps a key sequence to a KeyOps, keys of a sequence are separated
+ * by space, e.g. "C-x k". A key is written as in emacs, "C-a" for Ctrl-A,
+ * "M-g" for Alt-G, "RET", "TAB", "SPC", "DEL", "ESC", "<up>", "<pgdn>" or the
+ * character itself.
+ *
+ * Global bindings apply in every mode, bindings of a mode win over them. The
+ * keymap file has the same "keys = op" lines as the config file, a [mode]
+ * line starts the bindings of a mode, and op "none" removes a binding.
+ */
+
+type Keymap struct {
+	global map[string]KeyOps
+	modes  map[Mode]map[string]KeyOps
+}
+
+var defaultKeys = map[string]KeyOps{
+	"C-x C-x":  ExitOp,
+	"C-x C-g":  CancelOp,
+	"C-x k":    CloseFileOp,
+	"C-x u":    UndoOp,
+	"C-x r":    RedoOp,
+	"C-x w":    ToggleWrapOp,
+	"C-x %":    ReplaceAllOp,
+	"C-x g":    GrepOp,
+	"C-x l":    ToggleLineEndingOp,
+	"C-x e":    ReopenEncodingOp,
+	"C-x E":    SaveEncodingOp,
+	"C-x C-p":  CommandOp,
+	"C-u":      UniversalArgOp,
+	"M-0":      DigitArgOp,
+	"M-1":      DigitArgOp,
+	"M-2":      DigitArgOp,
+	"M-3":      DigitArgOp,
+	"M-4":      DigitArgOp,
+	"M-5":      DigitArgOp,
+	"M-6":      DigitArgOp,
+	"M-7":      DigitArgOp,
+	"M-8":      DigitArgOp,
+	"M-9":      DigitArgOp,
+	"C-x (":    StartMacroOp,
+	"<f3>":     StartMacroOp,
+	"C-x )":    StopMacroOp,
+	"C-x m":    RunMacroOp,
+	"<f4>":     RunMacroOp,
+	"M-x":      CommandOp,
+	"M-,":      PrevBufferOp,
+	"M-.":      NextBufferOp,
+	"M-u":      UndoOp,
+	"M-r":      RedoOp,
+	"M-w":      CopyRegionOp,
+	"M-y":      YankPopOp,
+	"M-%":      ReplaceOp,
+	"M-c":      ToggleCaseOp,
+	"M-l":      ToggleLiteralOp,
+	"M-o":      ToggleWordOp,
+	"M-p":      HistoryPrevOp,
+	"M-n":      HistoryNextOp,
+	"M-g":      GoToLineOp,
+	"M-f":      ForwardWordOp,
+	"M-b":      BackwardWordOp,
+	"M-d":      KillWordOp,
+	"M-DEL":    BackwardKillWordOp,
+	"C-SPC":    SetMarkOp,
+	"C-g":      CancelOp,
+	"C-r":      OpenFileOp,
+	"C-o":      SaveFileOp,
+	"C-s":      SearchOp,
+	"C-/":      HelpOp,
+	"C-a":      GoToBOLOp,
+	"C-e":      GoToEOLOp,
+	"C-v":      NextHalfPageOp,
+	"<pgdn>":   NextHalfPageOp,
+	"C-z":      PrevHalfPageOp,
+	"<pgup>":   PrevHalfPageOp,
+	"C-k":      DeleteLineOp,
+	"C-w":      KillRegionOp,
+	"C-y":      YankOp,
+	"<up>":     MoveCursorUpOp,
+	"C-p":      MoveCursorUpOp,
+	"<down>":   MoveCursorDownOp,
+	"C-n":      MoveCursorDownOp,
+	"<left>":   MoveCursorLeftOp,
+	"<right>":  MoveCursorRightOp,
+	"RET":      InsertEnterOp,
+	"C-h":      DeleteChOp,
+	"DEL":      DeleteChOp,
+	"<delete>": DeleteForwardChOp,
+	"SPC":      InsertSpaceOp,
+	"TAB":      InsertTabOp,
+	"C-b":      NextBufferOp,
+}
+
+// Names of modes in keymap file, confirm modes read plain characters
+var modeNames = map[Mode]string{
+	EditMode:         "edit",
+	FileOpenMode:     "open",
+	FileSaveMode:     "save",
+	DirMode:          "dir",
+	HexMode:          "hex",
+	SearchMode:       "search",
+	GoToLineMode:     "goto-line",
+	EncodingMode:     "encoding",
+	ReplaceMode:      "replace",
+	ReplaceWithMode:  "replace-with",
+	QueryReplaceMode: "query-replace",
+	GrepMode:         "grep",
+	CommandMode:      "command",
+	CommandArgMode:   "command-arg",
+}
+
+// Names of keys without a printable character
+var specialKeyNames = map[tm.Key]string{
+	tm.KeyCtrlSpace:  "C-SPC",
+	tm.KeyTab:        "TAB",
+	tm.KeyEnter:      "RET",
+	tm.KeyEsc:        "ESC",
+	tm.KeySpace:      "SPC",
+	tm.KeyBackspace2: "DEL",
+	tm.KeyCtrlSlash:  "C-/",
+	tm.KeyArrowUp:    "<up>",
+	tm.KeyArrowDown:  "<down>",
+	tm.KeyArrowLeft:  "<left>",
+	tm.KeyArrowRight: "<right>",
+	tm.KeyPgup:       "<pgup>",
+	tm.KeyPgdn:       "<pgdn>",
+	tm.KeyHome:       "<home>",
+	tm.KeyEnd:        "<end>",
+	tm.KeyInsert:     "<insert>",
+	tm.KeyDelete:     "<delete>",
+	tm.KeyF1:         "<f1>",
+	tm.KeyF2:         "<f2>",
+	tm.KeyF3:         "<f3>",
+	tm.KeyF4:         "<f4>",
+	tm.KeyF5:         "<f5>",
+	tm.KeyF6:         "<f6>",
+	tm.KeyF7:         "<f7>",
+	tm.KeyF8:         "<f8>",
+	tm.KeyF9:         "<f9>",
+	tm.KeyF10:        "<f10>",
+	tm.KeyF11:        "<f11>",
+	tm.KeyF12:        "<f12>",
+}
+
+// Return the name of the key pressed in event, "" if it has no name
+func getKeyName(event tm.Event) string {
+	prefix := ""
+	if event.Mod&tm.ModAlt != 0 {
+		prefix = "M-"
+	}
+	if event.Ch == ' ' {
+		return prefix + "SPC"
+	}
+	if event.Ch != 0 {
+		return prefix + string(event.Ch)
+	}
+	if name, ok := specialKeyNames[event.Key]; ok {
+		return prefix + name
+	}
+	if event.Key >= tm.KeyCtrlA && event.Key <= tm.KeyCtrlZ {
+		return prefix + "C-" + string(rune('a'+event.Key-tm.KeyCtrlA))
+	}
+	return ""
+}
+
+// Return the key event of a key name
+func parseKey(name string) (tm.Event, error) {
+	event := tm.Event{Type: tm.EventKey}
+	rest := name
+	if strings.HasPrefix(rest, "M-") && len(rest) > 2 {
+		event.Mod = tm.ModAlt
+		rest = rest[2:]
+	}
+	if r := []rune(rest); len(r) == 1 {
+		event.Ch = r[0]
+		return event, nil
+	}
+	for key, keyName := range specialKeyNames {
+		if keyName == rest {
+			event.Key = key
+			return event, nil
+		}
+	}
+	if r := []rune(rest); len(r) == 3 && strings.HasPrefix(rest, "C-") && r[2] >= 'a' && r[2] <= 'z' {
+		event.Key = tm.KeyCtrlA + tm.Key(r[2]-'a')
+		return event, nil
+	}
+	return event, fmt.Errorf("unknown key %q", name)
+}
+
+// Parse a key name and return it in the form getKeyName writes it
+func parseKeyName(name string) (string, error) {
+	event, err := parseKey(name)
+	if err != nil {
+		return "", err
+	}
+	return getKeyName(event), nil
+}
+
+// Parse a key sequence, e.g. "C-x  C-s", to its canonical form "C-x C-s"
+func parseKeySeq(seq string) (string, error) {
+	keys := strings.Fields(seq)
+	if len(keys) == 0 {
+		return "", fmt.Errorf("missing key")
+	}
+	for i, key := range keys {
+		name, err := parseKeyName(key)
+		if err != nil {
+			return "", err
+		}
+		keys[i] = name
+	}
+	return strings.Join(keys, " "), nil
+}
+
+func newKeymap() *Keymap {
+	km := &Keymap{
+		global: map[string]KeyOps{},
+		modes:  map[Mode]map[string]KeyOps{},
+	}
+	for seq, op := range defaultKeys {
+		km.global[seq] = op
+	}
+	for mode := range modeNames {
+		km.modes[mode] = map[string]KeyOps{}
+	}
+	return km
+}
+
+// Return the operation bound to seq in mode, a binding of the mode wins over
+// a global one
+func (km *Keymap) lookup(mode Mode, seq string) (KeyOps, bool) {
+	if op, ok := km.modes[mode][seq]; ok {
+		return op, op != NoOp
+	}
+	op, ok := km.global[seq]
+	return op, ok && op != NoOp
+}
+
+// Check if seq starts a longer binding in mode
+func (km *Keymap) isPrefix(mode Mode, seq string) bool {
+	for _, table := range []map[string]KeyOps{km.modes[mode], km.global} {
+		for key, op := range table {
+			if op != NoOp && strings.HasPrefix(key, seq+" ") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Return the shortest global key sequence bound to op, "" if there is none
+func (km *Keymap) getKeys(op KeyOps) string {
+	keys := ""
+	for seq, bound := range km.global {
+		if bound == op && (keys == "" || len(seq) < len(keys) || (len(seq) == len(keys) && seq < keys)) {
+			keys = seq
+		}
+	}
+	return keys
+}
+
+// Load bindings from the keymap file if there is one, over the defaults
+// A bad line is skipped and reported in the returned errors, so is a binding
+// which can never be reached because a shorter sequence is bound
+func (km *Keymap) Load(path string) []error {
+	errs := []error{}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return errs
+	}
+	if err != nil {
+		return append(errs, err)
+	}
+	defer f.Close()
+
+	table := km.global
+	section := "global"
+	// Line number of each binding in file, to report conflicting lines
+	bound := map[string]int{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		txt := strings.TrimSpace(scanner.Text())
+		if txt == "" || strings.HasPrefix(txt, "#") {
+			continue
+		}
+		if strings.HasPrefix(txt, "[") && strings.HasSuffix(txt, "]") {
+			section = strings.TrimSpace(txt[1 : len(txt)-1])
+			table = nil
+			for mode, name := range modeNames {
+				if name == section {
+					table = km.modes[mode]
+				}
+			}
+			if table == nil {
+				errs = append(errs, fmt.Errorf("%s:%d: unknown mode %q", path, n, section))
+			}
+			continue
+		}
+		if table == nil {
+			continue
+		}
+		// Op names have no "=", keys can be "=" or "M-="
+		i := strings.LastIndex(txt, "=")
+		if i < 0 {
+			errs = append(errs, fmt.Errorf("%s:%d: expected keys = op, got %q", path, n, txt))
+			continue
+		}
+		seq, err := parseKeySeq(txt[:i])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s:%d: %v", path, n, err))
+			continue
+		}
+		name := strings.TrimSpace(txt[i+1:])
+		op := NoOp
+		if cmd := getCommand(name); cmd != nil && cmd.run == nil {
+			op = cmd.op
+		} else if name != "none" {
+			errs = append(errs, fmt.Errorf("%s:%d: unknown op %q", path, n, name))
+			continue
+		}
+		if prev, ok := bound[section+"\x00"+seq]; ok && table[seq] != op {
+			errs = append(errs, fmt.Errorf("%s:%d: %s is already bound to %s on line %d", path, n, seq, getOpName(table[seq]), prev))
+		}
+		bound[section+"\x00"+seq] = n
+		table[seq] = op
+	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, fmt.Errorf("%s: %v", path, err))
+	}
+	for _, err := range km.checkConflicts("global", km.global, nil) {
+		errs = append(errs, fmt.Errorf("%s: %v", path, err))
+	}
+	modes := []Mode{}
+	for mode := range modeNames {
+		modes = append(modes, mode)
+	}
+	sort.Slice(modes, func(i, j int) bool { return modes[i] < modes[j] })
+	for _, mode := range modes {
+		for _, err := range km.checkConflicts(modeNames[mode], km.modes[mode], km.global) {
+			errs = append(errs, fmt.Errorf("%s: %v", path, err))
+		}
+	}
+	return errs
+}
+
+// Report bindings hidden by a shorter bound sequence, fallback is the global
+// table of a mode table, only conflicts involving the mode table are reported
+func (km *Keymap) checkConflicts(section string, table, fallback map[string]KeyOps) []error {
+	errs := []error{}
+	merged := map[string]KeyOps{}
+	for seq, op := range fallback {
+		merged[seq] = op
+	}
+	for seq, op := range table {
+		merged[seq] = op
+	}
+	seqs := make([]string, 0, len(merged))
+	for seq := range merged {
+		seqs = append(seqs, seq)
+	}
+	sort.Strings(seqs)
+	for _, seq := range seqs {
+		if merged[seq] == NoOp {
+			continue
+		}
+		keys := strings.Split(seq, " ")
+		for i := 1; i < len(keys); i++ {
+			prefix := strings.Join(keys[:i], " ")
+			if merged[prefix] == NoOp {
+				continue
+			}
+			_, inTable := table[seq]
+			_, prefixInTable := table[prefix]
+			if fallback == nil || inTable || prefixInTable {
+				errs = append(errs, fmt.Errorf("[%s] %s is unreachable, %s is bound to %s", section, seq, prefix, getOpName(merged[prefix])))
+			}
+			break
+		}
+	}
+	return errs
+}
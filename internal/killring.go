@@ -0,0 +1,65 @@
+package pine
+
+// KillRing keeps the most recent killed or copied texts, newest at the end
+// yankIdx points to the entry inserted by the last yank
+type KillRing struct {
+	entries [][]rune
+	yankIdx int
+}
+
+func (k *KillRing) Push(txt []rune) {
+	entry := make([]rune, len(txt))
+	copy(entry, txt)
+	k.entries = append(k.entries, entry)
+	if len(k.entries) > KILLRING_SIZE {
+		k.entries = k.entries[len(k.entries)-KILLRING_SIZE:]
+	}
+	k.yankIdx = len(k.entries) - 1
+}
+
+// Append txt to the newest entry, used by consecutive kills
+func (k *KillRing) Append(txt []rune) {
+	if k.isEmpty() {
+		k.Push(txt)
+		return
+	}
+	last := len(k.entries) - 1
+	k.entries[last] = append(k.entries[last], txt...)
+	k.yankIdx = last
+}
+
+// Prepend txt to the newest entry, used by consecutive kills moving backward
+func (k *KillRing) Prepend(txt []rune) {
+	if k.isEmpty() {
+		k.Push(txt)
+		return
+	}
+	last := len(k.entries) - 1
+	k.entries[last] = append(append([]rune{}, txt...), k.entries[last]...)
+	k.yankIdx = last
+}
+
+// Return the newest entry
+func (k *KillRing) Yank() []rune {
+	if k.isEmpty() {
+		return nil
+	}
+	k.yankIdx = len(k.entries) - 1
+	return k.entries[k.yankIdx]
+}
+
+// Return the entry before the last yanked one, wrapping around to the newest
+func (k *KillRing) Rotate() []rune {
+	if k.isEmpty() {
+		return nil
+	}
+	k.yankIdx--
+	if k.yankIdx < 0 {
+		k.yankIdx = len(k.entries) - 1
+	}
+	return k.entries[k.yankIdx]
+}
+
+func (k *KillRing) isEmpty() bool {
+	return len(k.entries) == 0
+}
@@ -0,0 +1,184 @@
+package pine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	tm "github.com/nsf/termbox-go"
+)
+
+/*
+ * Keyboard macro
+ *
+ * Key events are recorded as the editor handles them and played back through
+ * the same path. Keys of the command which stops recording are not part of
+ * the macro. Saved macros are key names, as in keymap files, under the state
+ * directory.
+ */
+
+// Macro records key events, last is the macro of the last finished recording
+type Macro struct {
+	recording bool
+	events    []tm.Event
+	// Number of events recorded before the current command started
+	cmdStart int
+	last     []tm.Event
+}
+
+func (m *Macro) Start() {
+	m.recording = true
+	m.events = []tm.Event{}
+	m.cmdStart = 0
+}
+
+// Record a key event, isCmdStart tells if it is the first key of a command
+func (m *Macro) Record(event tm.Event, isCmdStart bool) {
+	if isCmdStart {
+		m.cmdStart = len(m.events)
+	}
+	m.events = append(m.events, event)
+}
+
+// Stop recording and keep the macro, returns the number of keys recorded
+func (m *Macro) Stop() int {
+	m.recording = false
+	m.last = m.events[:m.cmdStart]
+	m.events = nil
+	return len(m.last)
+}
+
+func getMacroPath(name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid macro name %q", name)
+	}
+	dir, err := getStateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, MACRO_DIRNAME, name), nil
+}
+
+func (e *Editor) startMacro() {
+	if e.playing {
+		return
+	}
+	e.macro.Start()
+	e.setMsg("Recording macro, C-x ) to stop")
+}
+
+func (e *Editor) stopMacro() {
+	if !e.macro.recording {
+		e.setMsg("Not recording a macro")
+		return
+	}
+	e.setMsg(fmt.Sprintf("Macro recorded with %d keys", e.macro.Stop()))
+}
+
+// Run the last macro, times 0 runs it until it fails, makes no change or
+// has run on the last line of the buffer, at most MACRO_MAX_RUNS times
+// A macro fails when a search in it finds nothing or wraps around
+func (e *Editor) runMacro(times int) {
+	events := e.macro.last
+	if len(events) == 0 {
+		e.setMsg("No macro recorded")
+		return
+	}
+	e.playing = true
+	e.failed = false
+	runs, finished := 0, false
+	for times == 0 && runs < MACRO_MAX_RUNS || runs < times {
+		buf := e.getBuf()
+		cursor, edits := *buf.cursor, buf.edits
+		for _, event := range events {
+			e.processEvent(event)
+			if e.failed || e.isExit {
+				break
+			}
+		}
+		if e.failed || e.isExit {
+			break
+		}
+		runs++
+		if times == 0 && (buf != e.getBuf() || buf.isEmpty() || cursor.x >= len(buf.lines)-1 ||
+			(*buf.cursor == cursor && buf.edits == edits)) {
+			finished = true
+			break
+		}
+	}
+	e.playing = false
+	if e.failed {
+		e.setMsg(fmt.Sprintf("Macro stopped by a failed search after %d runs", runs))
+		return
+	}
+	if times == 0 && !finished {
+		e.setMsg(fmt.Sprintf("Macro stopped at the limit of %d runs before end of buffer", runs))
+		return
+	}
+	e.setMsg(fmt.Sprintf("Macro ran %d times", runs))
+}
+
+func runMacroTimes(e *Editor, arg string) error {
+	if e.macro.recording {
+		return fmt.Errorf("cannot run a macro while recording one")
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(arg))
+	if err != nil || n < 0 {
+		return fmt.Errorf("times must be a number, 0 runs until end of buffer")
+	}
+	e.runMacro(n)
+	return nil
+}
+
+// Save the last macro as key names
+func saveMacro(e *Editor, arg string) error {
+	if len(e.macro.last) == 0 {
+		return fmt.Errorf("no macro recorded")
+	}
+	path, err := getMacroPath(strings.TrimSpace(arg))
+	if err != nil {
+		return err
+	}
+	keys := make([]string, len(e.macro.last))
+	for i, event := range e.macro.last {
+		if keys[i] = getKeyName(event); keys[i] == "" {
+			return fmt.Errorf("key %d of macro has no name and cannot be saved", i+1)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, []byte(strings.Join(keys, " ")+"\n"), 0600); err != nil {
+		return err
+	}
+	e.setMsg(fmt.Sprintf("Macro saved to %s", path))
+	return nil
+}
+
+// Load a saved macro as the last macro and run it once
+func playMacro(e *Editor, arg string) error {
+	if e.macro.recording {
+		return fmt.Errorf("cannot play a macro while recording one")
+	}
+	path, err := getMacroPath(strings.TrimSpace(arg))
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	events := []tm.Event{}
+	for _, name := range strings.Fields(string(data)) {
+		event, err := parseKey(name)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		events = append(events, event)
+	}
+	e.macro.last = events
+	e.runMacro(1)
+	return nil
+}
@@ -0,0 +1,162 @@
+package pine
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PromptHistory keeps inputs of each prompt, oldest first
+// browseIdx is the entry shown in the prompt, the length of entries when the
+// prompt shows draft, which is the input typed before browsing
+type PromptHistory struct {
+	entries   map[string][]string
+	browseIdx int
+	draft     string
+	path      string
+	log       *log.Logger
+}
+
+// History file keeps one entry per line as "<prompt>\t<quoted input>"
+func (h *PromptHistory) Load() {
+	h.entries = map[string][]string{}
+	dir, err := getStateDir()
+	if err != nil {
+		h.log.Warnf("failed to locate history file: %v", err)
+		return
+	}
+	h.path = filepath.Join(dir, HISTORY_FILENAME)
+	f, err := os.Open(h.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			h.log.Warnf("failed to open history file %s: %v", h.path, err)
+		}
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		kind, quoted, found := strings.Cut(scanner.Text(), "\t")
+		if !found {
+			continue
+		}
+		input, err := strconv.Unquote(quoted)
+		if err != nil {
+			h.log.Warnf("skip invalid history entry %s: %v", quoted, err)
+			continue
+		}
+		h.entries[kind] = append(h.entries[kind], input)
+	}
+}
+
+func (h *PromptHistory) Save() {
+	if h.path == "" {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(h.path), 0755); err != nil {
+		h.log.Warnf("failed to create history directory: %v", err)
+		return
+	}
+	f, err := os.OpenFile(h.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		h.log.Warnf("failed to write history file %s: %v", h.path, err)
+		return
+	}
+	defer f.Close()
+	writer := bufio.NewWriter(f)
+	for kind, inputs := range h.entries {
+		for _, input := range inputs {
+			fmt.Fprintf(writer, "%s\t%s\n", kind, strconv.Quote(input))
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		h.log.Warnf("failed to write history file %s: %v", h.path, err)
+	}
+}
+
+// Start browsing history of a prompt from the newest entry
+func (h *PromptHistory) Reset(mode Mode) {
+	h.browseIdx = len(h.entries[getPromptName(mode)])
+	h.draft = ""
+}
+
+// Add an input to the prompt history and save it, a repeated input moves to the newest
+func (h *PromptHistory) Add(mode Mode, input string) {
+	kind := getPromptName(mode)
+	if kind == "" || input == "" {
+		return
+	}
+	inputs := []string{}
+	for _, entry := range h.entries[kind] {
+		if entry != input {
+			inputs = append(inputs, entry)
+		}
+	}
+	inputs = append(inputs, input)
+	if len(inputs) > HISTORY_SIZE {
+		inputs = inputs[len(inputs)-HISTORY_SIZE:]
+	}
+	h.entries[kind] = inputs
+	h.Save()
+}
+
+// Return the entry before the one shown, input is kept as draft when browsing starts
+func (h *PromptHistory) Prev(mode Mode, input string) (string, bool) {
+	inputs := h.entries[getPromptName(mode)]
+	if h.browseIdx > len(inputs) {
+		h.browseIdx = len(inputs)
+	}
+	if h.browseIdx == 0 {
+		return "", false
+	}
+	if h.browseIdx == len(inputs) {
+		h.draft = input
+	}
+	h.browseIdx--
+	return inputs[h.browseIdx], true
+}
+
+// Return the entry after the one shown, or the draft after the newest entry
+func (h *PromptHistory) Next(mode Mode) (string, bool) {
+	inputs := h.entries[getPromptName(mode)]
+	if h.browseIdx >= len(inputs) {
+		return "", false
+	}
+	h.browseIdx++
+	if h.browseIdx == len(inputs) {
+		return h.draft, true
+	}
+	return inputs[h.browseIdx], true
+}
+
+// Return the name of a prompt used in history file
+func getPromptName(mode Mode) string {
+	switch mode {
+	case FileOpenMode:
+		return "open"
+	case FileSaveMode:
+		return "save"
+	case SearchMode:
+		return "search"
+	case ReplaceMode:
+		return "replace"
+	case ReplaceWithMode:
+		return "replace-with"
+	case GrepMode:
+		return "grep"
+	case GoToLineMode:
+		return "goto"
+	case EncodingMode:
+		return "encoding"
+	case CommandMode:
+		return "command"
+	case CommandArgMode:
+		return "command-arg"
+	}
+	return ""
+}
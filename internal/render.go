@@ -4,14 +4,22 @@ import (
 	"fmt"
 	"strconv"
 
+	"github.com/mattn/go-runewidth"
 	tm "github.com/nsf/termbox-go"
 	log "github.com/sirupsen/logrus"
 )
 
 const (
-	FileOpenInfo = "Open file (^G to cancel): "
-	FileSaveInfo = "Save file (^G to cancel): "
-	SearchInfo   = "Search (^G to cancel): "
+	FileOpenInfo    = "Open file (^G to cancel): "
+	FileSaveInfo    = "Save file (^G to cancel): "
+	SearchInfo      = "Search%s (^G to cancel): "
+	ReplaceInfo     = "Replace (^G to cancel): "
+	ReplaceWithInfo = "Replace with (^G to cancel): "
+	GrepInfo        = "Grep (^G to cancel): "
+	GoToLineInfo    = "Go to line[:col], +N, -N or N% (^G to cancel): "
+	EncodingInfo    = "%s (utf-8, utf-16le, utf-16be, latin-1, gbk, shift-jis) (^G to cancel): "
+	CommandInfo     = "M-x (Tab to complete, ^G to cancel): "
+	CommandArgInfo  = "%s (^G to cancel): "
 )
 
 type Render struct {
@@ -32,21 +40,30 @@ type RenderContent struct {
 	ch       rune
 	bufIdx   int
 	bufDirty bool
+	search   string
+	flags    string
+	chord    string
+	// Keyboard macro is being recorded
+	recording bool
+	// Command palette candidates and the selected one
+	commands []string
+	selected int
+	prompt   string
 }
 
 // BufRender renders content of a buffer
 // ViewStartPos and ViewEndPos are the absolute coordinate of the view on terminal screen
 // ViewCursor is the absolute coordinate of the cusor
 // ViewAnchor is the coordinate of buffer content, used to calculate content outside of the screen
-// HlStartPos and hlEndPos are the view coordinate of the highlight area
+// Wrap enables soft wrap, anchorRow is the first visual row of the anchor line in wrap mode
 type BufRender struct {
-	viewStartPos   *Pos
-	viewEndPos     *Pos
-	viewCursor     *Pos
-	viewAnchor     *Pos
-	hlViewStartPos *Pos
-	hlViewEndPos   *Pos
-	log            *log.Logger
+	viewStartPos *Pos
+	viewEndPos   *Pos
+	viewCursor   *Pos
+	viewAnchor   *Pos
+	wrap         bool
+	anchorRow    int
+	log          *log.Logger
 }
 
 func (r *Render) Init(sett *Setting, logger *log.Logger) {
@@ -67,26 +84,29 @@ Update viewpoint of each rendering components
 End-1 Statusline
 End   Misc Buffer
 */
-func (r *Render) updateViewPos(mode Mode) {
+func (r *Render) updateViewPos(content RenderContent) {
+	mode := content.mode
 	r.termW, r.termH = tm.Size()
 	r.bufRender.viewStartPos = &Pos{BUFFER_CONTENT_START_OFFSET, 0}
 	if mode == DirMode {
 		r.bufRender.viewStartPos = &Pos{BUFFER_DIR_CONTENT_START_OFFSET, 0}
 	}
 	r.bufRender.viewEndPos = &Pos{r.termH + BUFFER_END_OFFSET, r.termW}
-	offset := 0
-	switch mode {
-	case FileOpenMode:
-		offset = len(FileOpenInfo)
-	case FileSaveMode:
-		offset = len(FileSaveInfo)
-	case SearchMode:
-		offset = len(SearchInfo)
-	}
+	offset := runewidth.StringWidth(getMiscInfo(content))
 	r.miscBufRender.viewStartPos = &Pos{r.termH - 1, offset}
 	r.miscBufRender.viewEndPos = &Pos{r.termH, r.termW}
 }
 
+// Update view positions and scroll views to cursors, done on every draw and
+// between moves which are not drawn
+func (r *Render) SyncView(content RenderContent) {
+	r.updateViewPos(content)
+	r.bufRender.SyncCursorToView(content.buf)
+	if isMiscMode(content.mode) {
+		r.miscBufRender.SyncCursorToView(content.miscBuf)
+	}
+}
+
 func (r *Render) Clear() {
 	if err := tm.Clear(tm.ColorDefault, tm.ColorDefault); err != nil {
 		r.log.Error("failed to clear screen")
@@ -97,11 +117,7 @@ func (r *Render) Draw(content RenderContent) {
 	r.Clear()
 	defer tm.Flush()
 
-	r.updateViewPos(content.mode)
-	r.bufRender.SyncCursorToView(content.buf)
-	if content.mode == FileOpenMode || content.mode == FileSaveMode || content.mode == SearchMode {
-		r.miscBufRender.SyncCursorToView(content.miscBuf)
-	}
+	r.SyncView(content)
 
 	r.drawHeadline(content)
 
@@ -109,22 +125,20 @@ func (r *Render) Draw(content RenderContent) {
 		r.drawDir(content.buf.filePath)
 	}
 
-	miscMode := false
-	if content.mode == FileOpenMode || content.mode == FileSaveMode || content.mode == SearchMode {
-		miscMode = true
-	}
-	r.bufRender.Draw(content.buf, !miscMode, content.mode == SearchMode)
-	r.miscBufRender.Draw(content.miscBuf, miscMode, false)
+	miscMode := isMiscMode(content.mode)
+	r.bufRender.Draw(content.buf, !miscMode)
+	r.miscBufRender.Draw(content.miscBuf, miscMode)
 	if miscMode {
-		r.drawMiscInfo(content.mode)
+		r.drawMiscInfo(content)
 	}
+	r.drawCommands(content)
 
 	r.drawStatusline(content)
 }
 
 func (r *Render) MoveCursor(mode Mode, buf *Buffer, op KeyOps) {
 	bufRender := r.bufRender
-	if mode == FileOpenMode || mode == FileSaveMode || mode == SearchMode {
+	if isMiscMode(mode) {
 		bufRender = r.miscBufRender
 	}
 	if buf.isEmpty() {
@@ -147,6 +161,14 @@ func (r *Render) MoveCursorByMouse(buf *Buffer, p Pos, mode Mode) {
 	r.bufRender.MoveCursorByMouse(buf, p, mode)
 }
 
+// Toggle soft wrap of the main buffer and return whether it is enabled
+func (r *Render) ToggleWrap() bool {
+	r.bufRender.wrap = !r.bufRender.wrap
+	r.bufRender.viewAnchor.y = 0
+	r.bufRender.anchorRow = 0
+	return r.bufRender.wrap
+}
+
 func (r *Render) drawHeadline(content RenderContent) {
 	for i := 0; i < r.termW; i++ {
 		tm.SetCell(i, 0, rune(' '), tm.ColorBlack, tm.ColorWhite)
@@ -167,22 +189,69 @@ func (r *Render) drawStatusline(content RenderContent) {
 		tm.SetCell(i, x, rune(' '), tm.ColorCyan, tm.ColorCyan)
 	}
 	buf := content.buf
-	tbprint(x, 0, tm.ColorBlack, tm.ColorCyan, fmt.Sprintf("%06d,%06d %4d%%  %x-%s:%x %d:%d", buf.cursor.x, buf.cursor.y, getLinePer(buf), int(content.mod), string(content.ch), int(content.key), r.bufRender.hlViewStartPos.x, r.bufRender.hlViewStartPos.y))
+	tbprint(x, 0, tm.ColorBlack, tm.ColorCyan, fmt.Sprintf("%06d,%06d %4d%%  %s  %x-%s:%x", buf.cursor.x, buf.cursor.y, getLinePer(buf), buf.getFormat(), int(content.mod), string(content.ch), int(content.key)))
 	statusTailMsg := "^/ Help    ^X Exit"
+	if content.search != "" {
+		statusTailMsg = fmt.Sprintf("[%s]    %s", content.search, statusTailMsg)
+	}
+	if content.recording {
+		statusTailMsg = fmt.Sprintf("Recording macro    %s", statusTailMsg)
+	}
+	if content.chord != "" {
+		statusTailMsg = fmt.Sprintf("%s    %s", content.chord, statusTailMsg)
+	}
 	tbprint(x, r.termW-len(statusTailMsg), tm.ColorBlack, tm.ColorCyan, statusTailMsg)
 }
 
-func (r *Render) drawMiscInfo(mode Mode) {
-	info := ""
-	switch mode {
+// Draw command palette candidates above status line
+func (r *Render) drawCommands(content RenderContent) {
+	x := r.termH - 1 + STATUSLINE_OFFSET - len(content.commands)
+	for i, cmd := range content.commands {
+		fg, bg := tm.ColorDefault, tm.ColorDefault
+		if i == content.selected {
+			fg, bg = tm.ColorBlack, tm.ColorWhite
+		}
+		for y := 0; y < r.termW; y++ {
+			tm.SetCell(y, x+i, ' ', fg, bg)
+		}
+		tbprint(x+i, 0, fg, bg, cmd)
+	}
+}
+
+func (r *Render) drawMiscInfo(content RenderContent) {
+	tbprint(r.miscBufRender.viewStartPos.x, 0, tm.ColorCyan, tm.ColorDefault, getMiscInfo(content))
+}
+
+// Return the prompt of a mode taking input from the misc buffer
+func getMiscInfo(content RenderContent) string {
+	switch content.mode {
 	case FileOpenMode:
-		info = FileOpenInfo
+		return FileOpenInfo
 	case FileSaveMode:
-		info = FileSaveInfo
+		return FileSaveInfo
 	case SearchMode:
-		info = SearchInfo
+		return fmt.Sprintf(SearchInfo, content.flags)
+	case ReplaceMode:
+		return ReplaceInfo
+	case ReplaceWithMode:
+		return ReplaceWithInfo
+	case GrepMode:
+		return GrepInfo
+	case GoToLineMode:
+		return GoToLineInfo
+	case EncodingMode:
+		return fmt.Sprintf(EncodingInfo, content.prompt)
+	case CommandMode:
+		return CommandInfo
+	case CommandArgMode:
+		return fmt.Sprintf(CommandArgInfo, content.prompt)
 	}
-	tbprint(r.miscBufRender.viewStartPos.x, 0, tm.ColorCyan, tm.ColorDefault, info)
+	return ""
+}
+
+// Check if the mode takes input from the misc buffer
+func isMiscMode(mode Mode) bool {
+	return getMiscInfo(RenderContent{mode: mode}) != ""
 }
 
 func (r *Render) drawDir(path string) {
@@ -209,18 +278,30 @@ func (r *BufRender) Reset() {
 	r.viewEndPos = &Pos{0, 0}
 	r.viewCursor = &Pos{0, 0}
 	r.viewAnchor = &Pos{0, 0}
-	r.hlViewStartPos = &Pos{-1, -1}
-	r.hlViewEndPos = &Pos{-1, -1}
+	r.anchorRow = 0
 }
 
-func (r *BufRender) Draw(buf *Buffer, hasCursor, hasHighlight bool) {
-	drawBuffer(buf, r.viewStartPos, r.viewEndPos, r.viewAnchor, r.viewCursor)
-	if hasCursor {
-		drawCursor(r.viewStartPos, r.viewAnchor, r.viewCursor)
+func (r *BufRender) Draw(buf *Buffer, hasCursor bool) {
+	if buf.isHex {
+		r.drawHexBuffer(buf)
+		if hasCursor {
+			drawCursor(r.viewStartPos, r.viewAnchor, r.viewCursor)
+		}
+		return
+	}
+	if r.wrap {
+		r.drawWrappedBuffer(buf)
+		if hasCursor {
+			drawCursor(r.viewStartPos, &Pos{0, 0}, r.viewCursor)
+		}
+	} else {
+		drawBuffer(buf, r.viewStartPos, r.viewEndPos, r.viewAnchor, r.viewCursor)
+		if hasCursor {
+			drawCursor(r.viewStartPos, r.viewAnchor, r.viewCursor)
+		}
 	}
-	r.updateHighlight(buf)
-	if hasHighlight {
-		drawHighlight(r.hlViewStartPos, r.hlViewEndPos, r.viewAnchor, r.viewStartPos, r.viewEndPos)
+	for _, hl := range buf.highlights {
+		r.drawHighlight(buf, hl)
 	}
 }
 
@@ -228,9 +309,39 @@ func (r *BufRender) Draw(buf *Buffer, hasCursor, hasHighlight bool) {
 // Cursor buffer position is different than terminal view
 // since runes can have multiple width
 func (r *BufRender) SyncCursorToView(buf *Buffer) {
+	if buf.isHex {
+		r.syncHexCursorToView(buf)
+		return
+	}
+	if r.wrap {
+		r.syncWrappedCursorToView(buf)
+		return
+	}
 	convertBufPosToViewPos(r.viewCursor, buf.cursor, r.viewAnchor, r.viewStartPos, r.viewEndPos, buf.lines)
 }
 
+// Scroll the view so that cursor is in the middle of it
+func (r *BufRender) CenterCursor(buf *Buffer) {
+	h := r.viewEndPos.x - r.viewStartPos.x
+	if r.wrap {
+		anchor, _ := r.getVisualPos(buf, *buf.cursor)
+		for i := 0; i < h/2; i++ {
+			prev, ok := r.prevRow(buf, anchor)
+			if !ok {
+				break
+			}
+			anchor = prev
+		}
+		r.setAnchor(anchor)
+		return
+	}
+	r.viewAnchor.x = buf.cursor.x - h/2
+	if r.viewAnchor.x < 0 {
+		r.viewAnchor.x = 0
+	}
+	r.viewAnchor.y = 0
+}
+
 /*
  * MoveCursor
  *
@@ -239,6 +350,10 @@ func (r *BufRender) SyncCursorToView(buf *Buffer) {
  */
 
 func (r *BufRender) moveCursorUp(buf *Buffer) {
+	if r.wrap {
+		r.moveWrappedCursorUp(buf)
+		return
+	}
 	if buf.cursor.x == 0 {
 		return
 	}
@@ -247,6 +362,10 @@ func (r *BufRender) moveCursorUp(buf *Buffer) {
 }
 
 func (r *BufRender) moveCursorDown(buf *Buffer) {
+	if r.wrap {
+		r.moveWrappedCursorDown(buf)
+		return
+	}
 	if buf.cursor.x == len(buf.lines)-1 {
 		return
 	}
@@ -254,11 +373,11 @@ func (r *BufRender) moveCursorDown(buf *Buffer) {
 	r.syncViewPosToCursor(buf, Pos{r.viewCursor.x - r.viewAnchor.x, r.viewCursor.y - r.viewAnchor.y})
 }
 
+// View is scrolled back to line start if it is out of sync with cursor,
+// e.g. after moves with no render in between
 func (r *BufRender) moveCursorLeft(buf *Buffer) {
-	if buf.cursor.y == 0 && r.viewAnchor.y > 0 {
-		r.log.Fatalf("cursor %d and viewpoint %d out of sync", buf.cursor.y, r.viewAnchor.y)
-	}
 	if buf.cursor.y == 0 {
+		r.viewAnchor.y = 0
 		return
 	}
 	buf.cursor.y--
@@ -287,6 +406,10 @@ func (r *BufRender) MoveCursorByMouse(buf *Buffer, p Pos, mode Mode) {
 		offset += 1
 	}
 	viewCursorPos := Pos{p.x - offset, p.y}
+	if r.wrap {
+		r.moveWrappedCursorTo(buf, Pos{viewCursorPos.x, viewCursorPos.y - r.viewStartPos.y})
+		return
+	}
 	r.syncViewPosToCursor(buf, viewCursorPos)
 }
 
@@ -312,6 +435,10 @@ func (r *BufRender) syncViewPosToCursor(buf *Buffer, viewPos Pos) {
 
 func (r *BufRender) moveCursorToNextHalfScreen(buf *Buffer) {
 	h := r.viewEndPos.x - r.viewStartPos.x
+	if r.wrap {
+		r.moveWrappedCursorRows(buf, h/2)
+		return
+	}
 	if buf.cursor.x+h/2 >= len(buf.lines) {
 		buf.cursor.x = len(buf.lines) - 1
 	} else {
@@ -322,6 +449,10 @@ func (r *BufRender) moveCursorToNextHalfScreen(buf *Buffer) {
 
 func (r *BufRender) moveCursorToPrevHalfScreen(buf *Buffer) {
 	h := r.viewEndPos.x - r.viewStartPos.x
+	if r.wrap {
+		r.moveWrappedCursorRows(buf, -h/2)
+		return
+	}
 	if buf.cursor.x-h/2 < 0 {
 		buf.cursor.x = 0
 	} else {
@@ -333,7 +464,51 @@ func (r *BufRender) moveCursorToPrevHalfScreen(buf *Buffer) {
 	r.syncViewPosToCursor(buf, Pos{buf.cursor.x - r.viewAnchor.x, buf.cursor.y - r.viewAnchor.y})
 }
 
-func (r *BufRender) updateHighlight(buf *Buffer) {
-	convertBufPosToViewPos(r.hlViewStartPos, buf.hlStartPos, r.viewAnchor, r.viewStartPos, r.viewEndPos, buf.lines)
-	convertBufPosToViewPos(r.hlViewEndPos, buf.hlEndPos, r.viewAnchor, r.viewStartPos, r.viewEndPos, buf.lines)
+// Paint cells of a highlight range on visible lines
+// Highlight follows the view, it must not scroll the view away from the cursor
+func (r *BufRender) drawHighlight(buf *Buffer, hl highlight) {
+	fg, bg := getHighlightColor(hl.style)
+	h := r.viewEndPos.x - r.viewStartPos.x
+	start := hl.startPos.x
+	if start < r.viewAnchor.x {
+		start = r.viewAnchor.x
+	}
+	for x := start; x <= hl.endPos.x && x < len(buf.lines) && x < r.viewAnchor.x+h; x++ {
+		txt := buf.lines[x].txt
+		// A range continuing to next line covers the end of line as well
+		from, to := 0, len(txt)+1
+		if x == hl.startPos.x {
+			from = hl.startPos.y
+		}
+		if x == hl.endPos.x {
+			to = hl.endPos.y
+		}
+		starts := []int{0}
+		if r.wrap {
+			starts = r.getLineRows(buf, x)
+		}
+		rowOffsets := r.getRowOffsets(buf, x, starts)
+		cells := layoutLine(txt, starts)
+		for i := from; i < to && i < len(cells); i++ {
+			cell := cells[i]
+			row := r.viewStartPos.x + rowOffsets[cell.row]
+			col := r.viewStartPos.y + cell.col
+			if !r.wrap {
+				col -= r.viewAnchor.y
+			}
+			paintCells(row, col, cell.width, fg, bg, r.viewStartPos, r.viewEndPos)
+		}
+	}
+}
+
+// Return view row of each visual row of a line relative to the view start
+func (r *BufRender) getRowOffsets(buf *Buffer, x int, starts []int) []int {
+	if !r.wrap {
+		return []int{x - r.viewAnchor.x}
+	}
+	offsets := make([]int, len(starts))
+	for row := range starts {
+		offsets[row] = r.getViewRow(buf, visualPos{x, row})
+	}
+	return offsets
 }
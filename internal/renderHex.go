@@ -0,0 +1,103 @@
+package pine
+
+import (
+	"fmt"
+	"strings"
+
+	tm "github.com/nsf/termbox-go"
+)
+
+/*
+ * Hex view
+ *
+ * Each row shows the offset, HEX_ROW_LEN bytes in hex and the same bytes as
+ * ASCII, e.g. "00000010  48 65 6c 6c 6f 00 ...  |Hello.|". viewAnchor.x is
+ * the first row in the view.
+ */
+
+// Return the column of a byte of a row in hex column
+func getHexCol(i int) int {
+	col := HEX_OFFSET_WIDTH + 2 + i*3
+	if i >= HEX_ROW_LEN/2 {
+		col++
+	}
+	return col
+}
+
+// Return the column of a byte of a row in ASCII column
+func getHexASCIICol(i int) int {
+	return getHexCol(HEX_ROW_LEN-1) + 5 + i
+}
+
+func (r *BufRender) syncHexCursorToView(buf *Buffer) {
+	h := r.viewEndPos.x - r.viewStartPos.x
+	row := buf.cursor.x / HEX_ROW_LEN
+	if row < r.viewAnchor.x {
+		r.viewAnchor.x = row
+	}
+	if row >= r.viewAnchor.x+h {
+		r.viewAnchor.x = row - h + 1
+	}
+	r.viewAnchor.y = 0
+	r.viewCursor.x = row
+	i := buf.cursor.x % HEX_ROW_LEN
+	if buf.hexASCII {
+		r.viewCursor.y = getHexASCIICol(i)
+	} else {
+		r.viewCursor.y = getHexCol(i) + buf.cursor.y
+	}
+}
+
+func (r *BufRender) drawHexBuffer(buf *Buffer) {
+	h := r.viewEndPos.x - r.viewStartPos.x
+	for i := 0; i < h; i++ {
+		offset := (r.viewAnchor.x + i) * HEX_ROW_LEN
+		if offset >= len(buf.data) {
+			break
+		}
+		end := offset + HEX_ROW_LEN
+		if end > len(buf.data) {
+			end = len(buf.data)
+		}
+		tbprint(r.viewStartPos.x+i, r.viewStartPos.y, tm.ColorDefault, tm.ColorDefault, formatHexRow(offset, buf.data[offset:end]))
+	}
+	// Show the byte under cursor in the other column
+	if len(buf.data) > 0 && buf.cursor.x/HEX_ROW_LEN >= r.viewAnchor.x {
+		x := r.viewStartPos.x + buf.cursor.x/HEX_ROW_LEN - r.viewAnchor.x
+		i := buf.cursor.x % HEX_ROW_LEN
+		fg, bg := getHighlightColor(RegionHighlight)
+		if buf.hexASCII {
+			tbprint(x, r.viewStartPos.y+getHexCol(i), fg, bg, fmt.Sprintf("%02x", buf.data[buf.cursor.x]))
+		} else {
+			tbprint(x, r.viewStartPos.y+getHexASCIICol(i), fg, bg, string(getHexASCII(buf.data[buf.cursor.x])))
+		}
+	}
+}
+
+func formatHexRow(offset int, data []byte) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("%0*x  ", HEX_OFFSET_WIDTH, offset))
+	for i := 0; i < HEX_ROW_LEN; i++ {
+		if i == HEX_ROW_LEN/2 {
+			sb.WriteByte(' ')
+		}
+		if i < len(data) {
+			sb.WriteString(fmt.Sprintf("%02x ", data[i]))
+		} else {
+			sb.WriteString("   ")
+		}
+	}
+	sb.WriteString(" |")
+	for _, c := range data {
+		sb.WriteRune(getHexASCII(c))
+	}
+	sb.WriteString("|")
+	return sb.String()
+}
+
+func getHexASCII(c byte) rune {
+	if c < 0x20 || c >= 0x7F {
+		return '.'
+	}
+	return rune(c)
+}
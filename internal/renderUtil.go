@@ -2,12 +2,19 @@ package pine
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/mattn/go-runewidth"
 	tm "github.com/nsf/termbox-go"
 )
 
 func getLinePer(buf *Buffer) int {
+	if buf.isHex {
+		if len(buf.data) == 0 {
+			return 0
+		}
+		return (buf.cursor.x + 1) * 100 / len(buf.data)
+	}
 	if len(buf.lines) > 0 {
 		return int((buf.cursor.x + 1) * 100 / len(buf.lines))
 	}
@@ -19,10 +26,7 @@ func drawBuffer(
 	viewStartPos, viewEndPos, viewAnchor, viewCursor *Pos,
 ) {
 	viewIndex := 0
-	for i := 0; i < len(buf.lines); i++ {
-		if i < viewAnchor.x {
-			continue
-		}
+	for i := viewAnchor.x; i < len(buf.lines); i++ {
 		// Buffer lines are out of current view point
 		if viewIndex == viewEndPos.x-viewStartPos.x {
 			break
@@ -37,21 +41,24 @@ func drawBufferLine(
 	i, viewIndex int,
 	viewStartPos, viewEndPos, viewAnchor, viewCursor *Pos,
 ) {
-	renderedData := ""
+	var rendered strings.Builder
 	y := 0
 	for _, ch := range line.txt {
-		renderedCh := ""
+		// Rest of a long line is out of the view
+		if y > viewAnchor.y+viewEndPos.y-viewStartPos.y {
+			break
+		}
 		if ch == rune('\t') {
-			renderedCh = drawTab(runeRenderedWidth(y, ch))
+			rendered.WriteString(drawTab(runeRenderedWidth(y, ch)))
 		} else {
-			renderedCh = string(ch)
+			rendered.WriteRune(ch)
 		}
 		y += runeRenderedWidth(y, ch)
-		renderedData += renderedCh
 	}
 	if y < viewAnchor.y {
 		return
 	}
+	renderedData := rendered.String()
 	// TODO: it can print out of the screen. but termbox-go handles
 	// this misbehavior. need to clean up this mess.
 	tbprint(i-viewAnchor.x+viewStartPos.x, viewStartPos.y, tm.ColorDefault, tm.ColorDefault, renderedData[viewAnchor.y:])
@@ -72,25 +79,53 @@ func drawCursor(viewStartPos, viewAnchor, viewCursor *Pos) {
 	tm.SetCursor(viewStartPos.y+viewCursor.y-viewAnchor.y, viewStartPos.x+viewCursor.x-viewAnchor.x)
 }
 
-func drawHighlight(hlViewStartPos, hlViewEndPos, viewAnchor, viewStartPos, viewEndPos *Pos) {
-	startX := hlViewStartPos.x + viewStartPos.x - viewAnchor.x
-	startY := hlViewStartPos.y + viewStartPos.y - viewAnchor.y
-	endX := hlViewEndPos.x + viewStartPos.x - viewAnchor.x
-	endY := hlViewEndPos.y + viewStartPos.y - viewAnchor.y
+// runeCell is where a rune is rendered within its line
+// Row is the visual row in wrap mode and always 0 otherwise
+type runeCell struct {
+	row, col, width int
+}
 
-	for i := startX; i <= endX; i++ {
-		for j := 0; j < viewEndPos.y-viewStartPos.y; j++ {
-			tm.SetBg(j, i, tm.ColorWhite)
-			tm.SetFg(j, i, tm.ColorBlack)
+// Return rendered cell of each rune of a line, plus one cell for the end of line
+// starts are rune indexes where visual rows start
+func layoutLine(txt []rune, starts []int) []runeCell {
+	cells := make([]runeCell, len(txt)+1)
+	row, col := 0, 0
+	for i := 0; i <= len(txt); i++ {
+		if row+1 < len(starts) && starts[row+1] == i {
+			row++
+			col = 0
+		}
+		width := 1
+		if i < len(txt) {
+			width = runeRenderedWidth(col, txt[i])
 		}
+		cells[i] = runeCell{row: row, col: col, width: width}
+		col += width
 	}
-	for j := 0; j < startY; j++ {
-		tm.SetBg(j, startX, tm.ColorDefault)
-		tm.SetFg(j, startX, tm.ColorDefault)
+	return cells
+}
+
+func getHighlightColor(style HighlightStyle) (tm.Attribute, tm.Attribute) {
+	switch style {
+	case MatchHighlight:
+		return tm.ColorWhite, tm.ColorBlue
+	case CurrMatchHighlight:
+		return tm.ColorBlack, tm.ColorYellow
+	}
+	return tm.ColorBlack, tm.ColorWhite
+}
+
+// Paint width cells from (x, y) which are inside the view
+func paintCells(x, y, width int, fg, bg tm.Attribute, viewStartPos, viewEndPos *Pos) {
+	if x < viewStartPos.x || x >= viewEndPos.x {
+		return
 	}
-	for j := endY; j < viewEndPos.y-viewStartPos.y; j++ {
-		tm.SetBg(j, endX, tm.ColorDefault)
-		tm.SetFg(j, endX, tm.ColorDefault)
+	for j := y; j < y+width; j++ {
+		if j < viewStartPos.y || j >= viewEndPos.y {
+			continue
+		}
+		tm.SetBg(j, x, bg)
+		tm.SetFg(j, x, fg)
 	}
 }
 
@@ -101,16 +136,23 @@ func convertBufPosToViewPos(
 	if len(lines) <= 0 || bufPos.x < 0 || bufPos.x >= len(lines) {
 		return
 	}
+	bufPosToViewPos(viewPos, bufPos, lines)
+	offsetView(viewPos, viewAnchor, viewStartPos, viewEndPos)
+}
+
+// Convert buffer position to view position without moving the view
+// Invalid buffer position is converted to (-1,-1)
+func bufPosToViewPos(viewPos, bufPos *Pos, lines []line) {
+	if len(lines) <= 0 || bufPos.x < 0 || bufPos.x >= len(lines) {
+		viewPos.x, viewPos.y = -1, -1
+		return
+	}
 	viewPos.x = bufPos.x
 	viewPos.y = 0
 	currLine := &lines[bufPos.x]
-	if len(currLine.txt) > 0 {
-		for j := 0; j < bufPos.y; j++ {
-			viewPos.y += runeRenderedWidth(viewPos.y, currLine.txt[j])
-		}
+	for j := 0; j < bufPos.y && j < len(currLine.txt); j++ {
+		viewPos.y += runeRenderedWidth(viewPos.y, currLine.txt[j])
 	}
-
-	offsetView(viewPos, viewAnchor, viewStartPos, viewEndPos)
 }
 
 func offsetView(viewPos, viewAnchor, viewStartPos, viewEndPos *Pos) {
@@ -0,0 +1,279 @@
+package pine
+
+import (
+	tm "github.com/nsf/termbox-go"
+)
+
+/*
+ * Soft wrap
+ *
+ * In wrap mode a buffer line is split into visual rows of the view width.
+ * A visual row is addressed by its buffer line and row index within the line.
+ * The view starts at visual row (viewAnchor.x, anchorRow) and never scrolls
+ * horizontally. viewCursor is the cursor position relative to the view.
+ */
+
+type visualPos struct {
+	line, row int
+}
+
+// Return start rune index of each visual row of a line wrapped at width w
+// A rune which does not fit in the rest of a row moves to the next row
+// The end of line takes one column, so a full last row adds an empty row for the cursor
+func wrapLine(txt []rune, w int) []int {
+	starts := []int{0}
+	if w <= 0 {
+		return starts
+	}
+	rc := 0
+	for i, ch := range txt {
+		rw := runeRenderedWidth(rc, ch)
+		if rc+rw > w && rc > 0 {
+			starts = append(starts, i)
+			rc = 0
+			rw = runeRenderedWidth(rc, ch)
+		}
+		rc += rw
+	}
+	if rc+1 > w && rc > 0 {
+		starts = append(starts, len(txt))
+	}
+	return starts
+}
+
+// Return rune index range [start, end) of a visual row
+func getRowRange(txt []rune, starts []int, row int) (int, int) {
+	if row+1 < len(starts) {
+		return starts[row], starts[row+1]
+	}
+	return starts[row], len(txt)
+}
+
+func (r *BufRender) wrapWidth() int {
+	return r.viewEndPos.y - r.viewStartPos.y
+}
+
+func (r *BufRender) getLineRows(buf *Buffer, x int) []int {
+	if x < 0 || x >= len(buf.lines) {
+		return []int{0}
+	}
+	return wrapLine(buf.lines[x].txt, r.wrapWidth())
+}
+
+// Return the visual row and its column of a buffer position
+func (r *BufRender) getVisualPos(buf *Buffer, p Pos) (visualPos, int) {
+	if p.x < 0 || p.x >= len(buf.lines) {
+		return visualPos{0, 0}, 0
+	}
+	txt := buf.lines[p.x].txt
+	starts := r.getLineRows(buf, p.x)
+	row := 0
+	for k, start := range starts {
+		if start <= p.y {
+			row = k
+		}
+	}
+	col := 0
+	for i := starts[row]; i < p.y && i < len(txt); i++ {
+		col += runeRenderedWidth(col, txt[i])
+	}
+	return visualPos{p.x, row}, col
+}
+
+// Return the buffer position at the given column of a visual row
+func (r *BufRender) getBufPosAtCol(buf *Buffer, vp visualPos, col int) Pos {
+	if vp.line < 0 || vp.line >= len(buf.lines) {
+		return Pos{0, 0}
+	}
+	txt := buf.lines[vp.line].txt
+	starts := r.getLineRows(buf, vp.line)
+	start, end := getRowRange(txt, starts, vp.row)
+	idx := start
+	rc := 0
+	for rc < col && idx < end {
+		rc += runeRenderedWidth(rc, txt[idx])
+		idx++
+	}
+	// Only the last row holds the end of its range, others continue on next row
+	if idx == end && vp.row+1 < len(starts) && end > start {
+		idx = end - 1
+	}
+	return Pos{vp.line, idx}
+}
+
+func (r *BufRender) nextRow(buf *Buffer, vp visualPos) (visualPos, bool) {
+	if vp.row+1 < len(r.getLineRows(buf, vp.line)) {
+		return visualPos{vp.line, vp.row + 1}, true
+	}
+	if vp.line+1 < len(buf.lines) {
+		return visualPos{vp.line + 1, 0}, true
+	}
+	return vp, false
+}
+
+func (r *BufRender) prevRow(buf *Buffer, vp visualPos) (visualPos, bool) {
+	if vp.row > 0 {
+		return visualPos{vp.line, vp.row - 1}, true
+	}
+	if vp.line > 0 {
+		return visualPos{vp.line - 1, len(r.getLineRows(buf, vp.line-1)) - 1}, true
+	}
+	return vp, false
+}
+
+// Return the first visual row of the view, limited to buffer content
+func (r *BufRender) getAnchor(buf *Buffer) visualPos {
+	anchor := visualPos{r.viewAnchor.x, r.anchorRow}
+	if anchor.line >= len(buf.lines) {
+		anchor = visualPos{len(buf.lines) - 1, 0}
+	}
+	if anchor.line < 0 {
+		return visualPos{0, 0}
+	}
+	if rows := len(r.getLineRows(buf, anchor.line)); anchor.row >= rows {
+		anchor.row = rows - 1
+	}
+	return anchor
+}
+
+func (r *BufRender) setAnchor(anchor visualPos) {
+	r.viewAnchor.x = anchor.line
+	r.viewAnchor.y = 0
+	r.anchorRow = anchor.row
+}
+
+// Return the number of visual rows from the view start to vp
+// Rows before the view are -1, rows after the view are the view height
+func (r *BufRender) getViewRow(buf *Buffer, vp visualPos) int {
+	anchor := r.getAnchor(buf)
+	if vp.line < anchor.line || (vp.line == anchor.line && vp.row < anchor.row) {
+		return -1
+	}
+	h := r.viewEndPos.x - r.viewStartPos.x
+	curr := anchor
+	for i := 0; i < h; i++ {
+		if curr == vp {
+			return i
+		}
+		next, ok := r.nextRow(buf, curr)
+		if !ok {
+			break
+		}
+		curr = next
+	}
+	return h
+}
+
+// Scroll the view so that cursor is visible and update view cursor
+func (r *BufRender) syncWrappedCursorToView(buf *Buffer) {
+	cursor, col := r.getVisualPos(buf, *buf.cursor)
+	r.setAnchor(r.getAnchor(buf))
+	h := r.viewEndPos.x - r.viewStartPos.x
+	row := r.getViewRow(buf, cursor)
+	if row < 0 {
+		r.setAnchor(cursor)
+		row = 0
+	} else if row >= h {
+		anchor := cursor
+		for row = 0; row < h-1; row++ {
+			prev, ok := r.prevRow(buf, anchor)
+			if !ok {
+				break
+			}
+			anchor = prev
+		}
+		r.setAnchor(anchor)
+	}
+	r.viewCursor.x = row
+	r.viewCursor.y = col
+}
+
+func (r *BufRender) moveWrappedCursorUp(buf *Buffer) {
+	cursor, col := r.getVisualPos(buf, *buf.cursor)
+	prev, ok := r.prevRow(buf, cursor)
+	if !ok {
+		return
+	}
+	*buf.cursor = r.getBufPosAtCol(buf, prev, col)
+}
+
+func (r *BufRender) moveWrappedCursorDown(buf *Buffer) {
+	cursor, col := r.getVisualPos(buf, *buf.cursor)
+	next, ok := r.nextRow(buf, cursor)
+	if !ok {
+		return
+	}
+	*buf.cursor = r.getBufPosAtCol(buf, next, col)
+}
+
+// Move cursor by n visual rows, negative n moves up
+func (r *BufRender) moveWrappedCursorRows(buf *Buffer, n int) {
+	cursor, col := r.getVisualPos(buf, *buf.cursor)
+	for ; n > 0; n-- {
+		next, ok := r.nextRow(buf, cursor)
+		if !ok {
+			break
+		}
+		cursor = next
+	}
+	for ; n < 0; n++ {
+		prev, ok := r.prevRow(buf, cursor)
+		if !ok {
+			break
+		}
+		cursor = prev
+	}
+	*buf.cursor = r.getBufPosAtCol(buf, cursor, col)
+}
+
+// Move cursor to the visual row and column under the view position
+func (r *BufRender) moveWrappedCursorTo(buf *Buffer, viewPos Pos) {
+	if len(buf.lines) <= 0 {
+		return
+	}
+	curr := r.getAnchor(buf)
+	for i := 0; i < viewPos.x; i++ {
+		next, ok := r.nextRow(buf, curr)
+		if !ok {
+			break
+		}
+		curr = next
+	}
+	*buf.cursor = r.getBufPosAtCol(buf, curr, viewPos.y)
+}
+
+func (r *BufRender) drawWrappedBuffer(buf *Buffer) {
+	if len(buf.lines) <= 0 {
+		return
+	}
+	anchor := r.getAnchor(buf)
+	x := r.viewStartPos.x
+	for i := anchor.line; i < len(buf.lines) && x < r.viewEndPos.x; i++ {
+		txt := buf.lines[i].txt
+		starts := r.getLineRows(buf, i)
+		for row := range starts {
+			if i == anchor.line && row < anchor.row {
+				continue
+			}
+			if x >= r.viewEndPos.x {
+				break
+			}
+			start, end := getRowRange(txt, starts, row)
+			drawWrappedRow(txt[start:end], x, r.viewStartPos.y)
+			x++
+		}
+	}
+}
+
+func drawWrappedRow(txt []rune, x, y int) {
+	rc := 0
+	for _, ch := range txt {
+		rw := runeRenderedWidth(rc, ch)
+		if ch == rune('\t') {
+			tbprint(x, y+rc, tm.ColorDefault, tm.ColorDefault, drawTab(rw))
+		} else {
+			tm.SetCell(y+rc, x, ch, tm.ColorDefault, tm.ColorDefault)
+		}
+		rc += rw
+	}
+}
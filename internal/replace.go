@@ -0,0 +1,130 @@
+package pine
+
+import (
+	"regexp"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Replace keeps the state of a query replace or replace all run
+// Matches are searched from pos up to limitPos, limitPos.x is -1 if there is no limit
+// matchStartPos and matchEndPos are rune positions of the current match
+// lastEndPos is where the previous match ended, an empty match is not allowed there
+type Replace struct {
+	target        string
+	pattern       *regexp.Regexp
+	template      string
+	all           bool
+	count         int
+	pos           Pos
+	limitPos      Pos
+	matchStartPos Pos
+	matchEndPos   Pos
+	lastEndPos    Pos
+	matchRepl     []rune
+	log           *log.Logger
+}
+
+// Prepare a replace run on the buffer
+// The run covers the region if the mark is set, otherwise from cursor or
+// beginning of the buffer for replace all to the end of the buffer
+func (r *Replace) Start(target, template string, buffer *Buffer, all bool) error {
+	pattern, err := regexp.Compile(target)
+	if err != nil {
+		return err
+	}
+	r.pattern = pattern
+	r.template = template
+	r.all = all
+	r.count = 0
+	r.limitPos = Pos{-1, -1}
+	r.lastEndPos = Pos{-1, -1}
+	r.pos = *buffer.cursor
+	if all {
+		r.pos = Pos{0, 0}
+	}
+	if buffer.hasMark() {
+		r.pos, r.limitPos = buffer.getRegion()
+		buffer.ClearMark()
+	}
+	return nil
+}
+
+// Find the next match from current position and highlight it
+func (r *Replace) Next(buffer *Buffer) bool {
+	for x := r.pos.x; x < len(buffer.lines); x++ {
+		if r.limitPos.x >= 0 && x > r.limitPos.x {
+			return false
+		}
+		from := 0
+		if x == r.pos.x {
+			from = r.pos.y
+		}
+		if r.findInLine(buffer, x, from) {
+			buffer.ResetHightlight()
+			buffer.AddHighlight(r.matchStartPos, r.matchEndPos, CurrMatchHighlight)
+			*buffer.cursor = r.matchStartPos
+			return true
+		}
+	}
+	return false
+}
+
+// Replace the current match as a single undo step and move past it
+func (r *Replace) ReplaceCurr(buffer *Buffer) {
+	buffer.beginEdit()
+	r.replaceMatch(buffer)
+	buffer.endEdit()
+}
+
+// Leave the current match unchanged and move past it
+func (r *Replace) SkipCurr() {
+	r.moveAfter(r.matchEndPos)
+}
+
+// Replace every remaining match as a single undo step
+func (r *Replace) ReplaceRest(buffer *Buffer) {
+	buffer.beginEdit()
+	for r.Next(buffer) {
+		r.replaceMatch(buffer)
+	}
+	buffer.endEdit()
+	buffer.ResetHightlight()
+}
+
+func (r *Replace) replaceMatch(buffer *Buffer) {
+	buffer.DeleteText(r.matchStartPos, r.matchEndPos)
+	buffer.InsertText(r.matchRepl)
+	r.count++
+	delta := len(r.matchRepl) - (r.matchEndPos.y - r.matchStartPos.y)
+	if r.limitPos.x == r.matchStartPos.x {
+		r.limitPos.y += delta
+	}
+	r.moveAfter(Pos{r.matchStartPos.x, r.matchStartPos.y + len(r.matchRepl)})
+}
+
+func (r *Replace) moveAfter(p Pos) {
+	r.pos = p
+	r.lastEndPos = p
+}
+
+// Find the first match in line x starting at or after rune index from
+func (r *Replace) findInLine(buffer *Buffer, x, from int) bool {
+	txt := string(buffer.lines[x].txt)
+	for _, loc := range r.pattern.FindAllStringSubmatchIndex(txt, -1) {
+		start := utf8.RuneCountInString(txt[:loc[0]])
+		end := start + utf8.RuneCountInString(txt[loc[0]:loc[1]])
+		if start < from || (start == end && (Pos{x, start}) == r.lastEndPos) {
+			continue
+		}
+		if r.limitPos.x == x && end > r.limitPos.y {
+			return false
+		}
+		r.matchStartPos = Pos{x, start}
+		r.matchEndPos = Pos{x, end}
+		r.matchRepl = []rune(string(r.pattern.ExpandString(nil, r.template, txt, loc)))
+		return true
+	}
+	return false
+}
@@ -1,15 +1,29 @@
 package pine
 
 import (
+	"fmt"
 	"regexp"
+	"strings"
+	"unicode/utf8"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// Search keeps matches of the last search in rune positions
+// startPos is the cursor position when search started, used to pick the nearest
+// match and to restore the cursor on cancel
+// ignoreCase, literal and wholeWord are search options kept between searches
+// lastTarget is the pattern of the last finished search, used by search next
+// and previous
 type Search struct {
 	matchedStartPos  []*Pos
 	matchedEndPos    []*Pos
 	currCandidateIdx int
+	startPos         Pos
+	lastTarget       string
+	ignoreCase       bool
+	literal          bool
+	wholeWord        bool
 	log              *log.Logger
 }
 
@@ -18,26 +32,138 @@ func (s *Search) Search(target string, buffer *Buffer) {
 	s.matchedEndPos = []*Pos{}
 	s.currCandidateIdx = -1
 
-	r, err := regexp.Compile(target)
-	if err != nil {
-		log.Warnf("failed to search %s: %v", target, err)
+	if target == "" {
 		return
 	}
-
+	r := s.compile(target)
 	for i := 0; i < len(buffer.lines); i++ {
-		loc := r.FindAllStringIndex(string(buffer.lines[i].txt), -1)
-		for j := 0; j < len(loc); j++ {
-			s.matchedStartPos = append(s.matchedStartPos, &Pos{i, loc[j][0]})
-			s.matchedEndPos = append(s.matchedEndPos, &Pos{i, loc[j][1]})
+		for _, loc := range s.findInLine(r, buffer.lines[i].txt) {
+			s.matchedStartPos = append(s.matchedStartPos, &Pos{i, loc[0]})
+			s.matchedEndPos = append(s.matchedEndPos, &Pos{i, loc[1]})
 		}
 	}
 }
 
+func (s *Search) compile(target string) *regexp.Regexp {
+	pattern := target
+	if s.literal {
+		pattern = regexp.QuoteMeta(target)
+	}
+	if s.ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+	r, err := regexp.Compile(pattern)
+	if err == nil {
+		return r
+	}
+	// Pattern can be incomplete while typing, search it literally instead
+	s.log.Debugf("search %s literally: %v", target, err)
+	pattern = regexp.QuoteMeta(target)
+	if s.ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+	return regexp.MustCompile(pattern)
+}
+
+// Return rune offsets [start, end) of matches in a line
+// Regexp works on UTF-8 bytes, so byte offsets are counted back to runes
+func (s *Search) findInLine(r *regexp.Regexp, txt []rune) [][2]int {
+	str := string(txt)
+	matches := [][2]int{}
+	byteIdx, runeIdx := 0, 0
+	for _, loc := range r.FindAllStringIndex(str, -1) {
+		runeIdx += utf8.RuneCountInString(str[byteIdx:loc[0]])
+		start := runeIdx
+		runeIdx += utf8.RuneCountInString(str[loc[0]:loc[1]])
+		byteIdx = loc[1]
+		if s.wholeWord && !isWholeWord(txt, start, runeIdx) {
+			continue
+		}
+		matches = append(matches, [2]int{start, runeIdx})
+	}
+	return matches
+}
+
+// Check that a match is not preceded or followed by a word rune
+func isWholeWord(txt []rune, start, end int) bool {
+	if start == end {
+		return false
+	}
+	if start > 0 && isWordRune(txt[start-1]) {
+		return false
+	}
+	if end < len(txt) && isWordRune(txt[end]) {
+		return false
+	}
+	return true
+}
+
+func (s *Search) ToggleIgnoreCase() {
+	s.ignoreCase = !s.ignoreCase
+}
+
+func (s *Search) ToggleLiteral() {
+	s.literal = !s.literal
+}
+
+func (s *Search) ToggleWholeWord() {
+	s.wholeWord = !s.wholeWord
+}
+
+// Return enabled search options shown in the prompt, e.g. " [icase,word]"
+func (s *Search) Flags() string {
+	flags := []string{}
+	if s.ignoreCase {
+		flags = append(flags, "icase")
+	}
+	if s.literal {
+		flags = append(flags, "literal")
+	}
+	if s.wholeWord {
+		flags = append(flags, "word")
+	}
+	if len(flags) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" [%s]", strings.Join(flags, ","))
+}
+
+// Select the first match at or after the given position, wrapping around to the first match
+// Returns false if there is no match
+func (s *Search) SelectNearest(from Pos) bool {
+	if len(s.matchedStartPos) == 0 {
+		s.currCandidateIdx = -1
+		return false
+	}
+	s.currCandidateIdx = 0
+	for i, p := range s.matchedStartPos {
+		if !isPosBefore(*p, from) {
+			s.currCandidateIdx = i
+			break
+		}
+	}
+	return true
+}
+
+// Highlight all matches and the current candidate on top, then move cursor to the candidate
 func (s *Search) SetBufferHightlight(buffer *Buffer, target string) {
-	buffer.hlStartPos, buffer.hlEndPos = s.getHightlight(target)
-	buffer.cursor = buffer.hlStartPos
+	buffer.ResetHightlight()
+	for i := range s.matchedStartPos {
+		buffer.AddHighlight(*s.matchedStartPos[i], *s.matchedEndPos[i], MatchHighlight)
+	}
+	start, end := s.getHightlight(target)
+	buffer.AddHighlight(*start, *end, CurrMatchHighlight)
+	buffer.cursor = &Pos{start.x, start.y}
 }
 
 func (s *Search) getHightlight(target string) (*Pos, *Pos) {
 	return s.matchedStartPos[s.currCandidateIdx], s.matchedEndPos[s.currCandidateIdx]
 }
+
+// Return the position of current match among all matches, e.g. "2 of 5"
+func (s *Search) Status() string {
+	if len(s.matchedStartPos) == 0 || s.currCandidateIdx < 0 {
+		return "no match"
+	}
+	return fmt.Sprintf("%d of %d", s.currCandidateIdx+1, len(s.matchedStartPos))
+}
@@ -1,5 +1,172 @@
 package pine
 
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Setting
+ *
+ * Options are read from the config file, one "key = value" per line, lines
+ * starting with # are comments. The same options can be given on command
+ * line as --key=value, which win over the config file.
+ */
+
 type Setting struct {
-	IsDebug bool
+	IsDebug    bool
+	Backup     bool
+	TabWidth   int
+	ExpandTabs bool
+	AutoIndent bool
+	Mouse      bool
+	LogFile    string
+	LogLevel   string
+	Encoding   string
+	LineEnding string
+	// Options given on command line, applied again after the config file
+	flags [][2]string
+}
+
+func NewSetting() *Setting {
+	return &Setting{
+		TabWidth:   TABWIDTH,
+		AutoIndent: true,
+		Mouse:      true,
+		LogFile:    DEFAULT_LOG_PATH,
+		LogLevel:   "error",
+		Encoding:   UTF8Encoding,
+		LineEnding: "lf",
+	}
+}
+
+// Set an option by name from its text value
+func (s *Setting) Set(key, value string) error {
+	if opt := s.getBoolOption(key); opt != nil {
+		on, err := parseBoolOption(key, value)
+		if err != nil {
+			return err
+		}
+		*opt = on
+		return nil
+	}
+	switch key {
+	case "tab-width":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > MAX_TABWIDTH {
+			return fmt.Errorf("tab-width must be a number from 1 to %d, got %q", MAX_TABWIDTH, value)
+		}
+		s.TabWidth = n
+	case "log-file":
+		if value == "" {
+			return fmt.Errorf("log-file must not be empty")
+		}
+		s.LogFile = value
+	case "log-level":
+		switch value {
+		case "error", "warn", "info", "debug":
+			s.LogLevel = value
+		default:
+			return fmt.Errorf("log-level must be error, warn, info or debug, got %q", value)
+		}
+	case "encoding":
+		if !isSupportedEncoding(value) {
+			return fmt.Errorf("encoding must be one of %s, got %q", strings.Join(supportedEncodings, ", "), value)
+		}
+		s.Encoding = value
+	case "line-ending":
+		if value != "lf" && value != "crlf" {
+			return fmt.Errorf("line-ending must be lf or crlf, got %q", value)
+		}
+		s.LineEnding = value
+	default:
+		return fmt.Errorf("unknown option %q", key)
+	}
+	return nil
+}
+
+func (s *Setting) getBoolOption(key string) *bool {
+	switch key {
+	case "expand-tabs":
+		return &s.ExpandTabs
+	case "auto-indent":
+		return &s.AutoIndent
+	case "mouse":
+		return &s.Mouse
+	case "backup":
+		return &s.Backup
+	}
+	return nil
+}
+
+// Set an option given on command line, it is kept when the config file is loaded
+func (s *Setting) SetFlag(key, value string) error {
+	if err := s.Set(key, value); err != nil {
+		return err
+	}
+	s.flags = append(s.flags, [2]string{key, value})
+	return nil
+}
+
+// Load the config file if there is one, a bad line is skipped and reported
+// in the returned errors
+func (s *Setting) Load(path string) []error {
+	errs := []error{}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return errs
+	}
+	if err != nil {
+		return append(errs, err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		txt := strings.TrimSpace(scanner.Text())
+		if txt == "" || strings.HasPrefix(txt, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(txt, "=")
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s:%d: expected key = value, got %q", path, n, txt))
+			continue
+		}
+		if err := s.Set(strings.TrimSpace(key), strings.TrimSpace(value)); err != nil {
+			errs = append(errs, fmt.Errorf("%s:%d: %v", path, n, err))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, fmt.Errorf("%s: %v", path, err))
+	}
+	for _, flag := range s.flags {
+		s.Set(flag[0], flag[1])
+	}
+	return errs
+}
+
+func parseBoolOption(key, value string) (bool, error) {
+	switch value {
+	case "true", "on", "yes":
+		return true, nil
+	case "false", "off", "no":
+		return false, nil
+	}
+	return false, fmt.Errorf("%s must be on or off, got %q", key, value)
+}
+
+// Return the path of a config file, under $XDG_CONFIG_HOME/pine or ~/.config/pine
+func getConfigPath(name string) (string, error) {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(homeDir, ".config")
+	}
+	return filepath.Join(dir, "pine", name), nil
 }
@@ -0,0 +1,145 @@
+package pine
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+ * Swap file
+ *
+ * Content of a dirty buffer is written to a swap file under the state
+ * directory, named after the absolute file path, so that unsaved changes can
+ * be recovered after a crash. The swap file is removed when the buffer is
+ * saved, closed or becomes clean again.
+ */
+
+func getSwapPath(path string) (string, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	dir, err := getStateDir()
+	if err != nil {
+		return "", err
+	}
+	name := strings.ReplaceAll(absPath, string(filepath.Separator), "%") + SWAP_FILE_SUFFIX
+	return filepath.Join(dir, SWAP_DIRNAME, name), nil
+}
+
+// Check if the buffer can have a swap file
+func (b *Buffer) canSwap() bool {
+	return !b.readOnly && !b.isHex && b.hasFile()
+}
+
+// Check if a swap file is left for the buffer, e.g. by a crashed editor
+func (b *Buffer) hasLeftoverSwap() bool {
+	swapPath, err := getSwapPath(b.filePath)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(swapPath)
+	return err == nil
+}
+
+// Write buffer content to its swap file if it changed since the last write
+func (b *Buffer) writeSwap() error {
+	if !b.canSwap() || b.pendingSwap || b.edits == b.swapEdits {
+		return nil
+	}
+	if !b.dirty {
+		b.removeSwap()
+		return nil
+	}
+	swapPath, err := getSwapPath(b.filePath)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(swapPath), 0700); err != nil {
+		return err
+	}
+	var content bytes.Buffer
+	if _, err := b.writeLinesAs(&content, UTF8Encoding); err != nil {
+		return err
+	}
+	tmpPath := swapPath + ".tmp"
+	if err := os.WriteFile(tmpPath, content.Bytes(), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, swapPath); err != nil {
+		return err
+	}
+	b.swapEdits = b.edits
+	b.swapped = true
+	return nil
+}
+
+// Remove the swap file written for the buffer, a leftover swap file is kept
+// until the user decides what to do with it
+func (b *Buffer) removeSwap() {
+	if !b.swapped || b.pendingSwap {
+		return
+	}
+	if swapPath, err := getSwapPath(b.filePath); err == nil {
+		os.Remove(swapPath)
+	}
+	b.swapped = false
+}
+
+// Replace buffer content with the leftover swap file, the buffer stays dirty
+// until it is saved
+func (b *Buffer) recoverSwap() error {
+	swapPath, err := getSwapPath(b.filePath)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(swapPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	b.lines = []line{}
+	b.escaped = false
+	if err := b.readLines(f, 0); err != nil {
+		return err
+	}
+	*b.cursor = b.clampPos(*b.cursor)
+	b.ClearMark()
+	b.history.Reset()
+	b.history.markUnsaved()
+	b.edits++
+	b.pendingSwap = false
+	b.swapped = true
+	b.setDirty()
+	return nil
+}
+
+// Delete the leftover swap file
+func (b *Buffer) discardSwap() {
+	b.pendingSwap = false
+	b.swapped = true
+	b.removeSwap()
+}
+
+// Return a line diff from the file content to the leftover swap file
+func (b *Buffer) diffSwap() ([]string, error) {
+	swapPath, err := getSwapPath(b.filePath)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(swapPath)
+	if err != nil {
+		return nil, err
+	}
+	orig := make([]string, len(b.lines))
+	for i, l := range b.lines {
+		orig[i] = string(l.txt)
+	}
+	swap := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	for i := range swap {
+		swap[i] = strings.TrimSuffix(swap[i], "\r")
+	}
+	return diffLines(orig, swap), nil
+}
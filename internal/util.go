@@ -4,16 +4,20 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"unicode"
 
 	"github.com/mattn/go-runewidth"
 )
 
+// Tab width of the editor, set from Setting
+var tabWidth = TABWIDTH
+
 func runeRenderedWidth(
 	index int,
 	data rune,
 ) int {
 	if data == rune('\t') {
-		return TABWIDTH - index%TABWIDTH
+		return tabWidth - index%tabWidth
 	}
 	if data == ' ' {
 		return 1
@@ -21,6 +25,29 @@ func runeRenderedWidth(
 	return runewidth.RuneWidth(data)
 }
 
+// Word runes are letters, digits and underscore of any script
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// Check if position p comes before q in buffer order
+func isPosBefore(p, q Pos) bool {
+	return p.x < q.x || (p.x == q.x && p.y < q.y)
+}
+
+// Return the directory keeping editor state, $XDG_STATE_HOME/pine or ~/.local/state/pine
+func getStateDir() (string, error) {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(homeDir, ".local", "state")
+	}
+	return filepath.Join(dir, "pine"), nil
+}
+
 func expandHomeDir(path string) (string, error) {
 	homeDir, err := os.UserHomeDir()
 	fullPath := path
@@ -0,0 +1,99 @@
+package pine
+
+import "unicode"
+
+/*
+ * Word
+ *
+ * A word is a run of word runes of the same class. CJK text has no spaces
+ * between words, so a change between Han, Hiragana, Katakana, Hangul and other
+ * scripts also ends a word, e.g. "日本語のテキスト" has three words.
+ */
+
+// Return the class of a word rune, runes of a word share the same class
+func getWordClass(r rune) int {
+	switch {
+	case unicode.Is(unicode.Han, r):
+		return 1
+	case unicode.Is(unicode.Hiragana, r):
+		return 2
+	case unicode.Is(unicode.Katakana, r) || r == 'ー':
+		return 3
+	case unicode.Is(unicode.Hangul, r):
+		return 4
+	}
+	return 0
+}
+
+// Return the rune at p, a newline at end of line
+func (b *Buffer) getRuneAt(p Pos) rune {
+	if p.y >= len(b.lines[p.x].txt) {
+		return '\n'
+	}
+	return b.lines[p.x].txt[p.y]
+}
+
+// Return the position after p, false at end of buffer
+func (b *Buffer) getNextPos(p Pos) (Pos, bool) {
+	if p.y < len(b.lines[p.x].txt) {
+		return Pos{p.x, p.y + 1}, true
+	}
+	if p.x < len(b.lines)-1 {
+		return Pos{p.x + 1, 0}, true
+	}
+	return p, false
+}
+
+// Return the position before p, false at beginning of buffer
+func (b *Buffer) getPrevPos(p Pos) (Pos, bool) {
+	if p.y > 0 {
+		return Pos{p.x, p.y - 1}, true
+	}
+	if p.x > 0 {
+		return Pos{p.x - 1, len(b.lines[p.x-1].txt)}, true
+	}
+	return p, false
+}
+
+// Return the end of the word at or after p
+func (b *Buffer) getNextWordEnd(p Pos) Pos {
+	p = b.clampPos(p)
+	if b.isEmpty() {
+		return p
+	}
+	for !isWordRune(b.getRuneAt(p)) {
+		next, ok := b.getNextPos(p)
+		if !ok {
+			return p
+		}
+		p = next
+	}
+	class := getWordClass(b.getRuneAt(p))
+	for r := b.getRuneAt(p); isWordRune(r) && getWordClass(r) == class; r = b.getRuneAt(p) {
+		p, _ = b.getNextPos(p)
+	}
+	return p
+}
+
+// Return the start of the word before p
+func (b *Buffer) getPrevWordStart(p Pos) Pos {
+	p = b.clampPos(p)
+	if b.isEmpty() {
+		return p
+	}
+	class := -1
+	for {
+		prev, ok := b.getPrevPos(p)
+		if !ok {
+			return p
+		}
+		r := b.getRuneAt(prev)
+		if class < 0 && isWordRune(r) {
+			class = getWordClass(r)
+		}
+		if class >= 0 && (!isWordRune(r) || getWordClass(r) != class) {
+			return p
+		}
+		p = prev
+	}
+}